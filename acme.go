@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/256dpi/newdns"
+	"github.com/miekg/dns"
+)
+
+// acmeRecordLifetime is how long a challenge record is served if it is never
+// cleaned up.
+const acmeRecordLifetime = time.Hour
+
+// ACMEConfig configures the HTTP API that sets the TXT records of ACME DNS-01
+// challenges at runtime. The API is served on http_addr.
+type ACMEConfig struct {
+	// Token authenticates requests to the API. It is sent either as a bearer
+	// token or as the password of basic auth. It may also be a secret
+	// reference, see [resolveSecret]. The API is disabled if this is empty.
+	Token string `toml:"token"`
+}
+
+// acmeRecords is an in-memory overlay of the TXT records of ACME challenges.
+// It is kept across reloads of the zones.
+type acmeRecords struct {
+	mu  sync.Mutex
+	txt map[string][]acmeValue // normalized name -> values
+}
+
+type acmeValue struct {
+	value   string
+	expires time.Time
+}
+
+func newACMERecords() *acmeRecords {
+	return &acmeRecords{txt: make(map[string][]acmeValue)}
+}
+
+// present adds the value to the TXT records of the name. Names may have
+// several values at once, such as when a certificate for both a domain and its
+// wildcard is issued.
+func (r *acmeRecords) present(name, value string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	values := r.liveLocked(name)
+	values = append(values, acmeValue{value: value, expires: time.Now().Add(acmeRecordLifetime)})
+	r.txt[name] = values
+}
+
+// cleanup removes the value from the TXT records of the name, or all of them
+// if value is empty.
+func (r *acmeRecords) cleanup(name, value string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if value == "" {
+		delete(r.txt, name)
+		return
+	}
+
+	values := slices.DeleteFunc(r.liveLocked(name), func(v acmeValue) bool { return v.value == value })
+	if len(values) == 0 {
+		delete(r.txt, name)
+	} else {
+		r.txt[name] = values
+	}
+}
+
+// lookup returns the values of the name that have not expired.
+func (r *acmeRecords) lookup(name string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	values := r.liveLocked(name)
+	texts := make([]string, len(values))
+	for i, v := range values {
+		texts[i] = v.value
+	}
+	return texts
+}
+
+// liveLocked drops the expired values of the name and returns the others.
+func (r *acmeRecords) liveLocked(name string) []acmeValue {
+	now := time.Now()
+	values := slices.DeleteFunc(r.txt[name], func(v acmeValue) bool { return !now.Before(v.expires) })
+	if len(values) == 0 {
+		delete(r.txt, name)
+	} else {
+		r.txt[name] = values
+	}
+	return values
+}
+
+// answer returns the response to the query if the name has challenge records,
+// or nil otherwise. name is the normalized name of the question.
+func (r *acmeRecords) answer(set *zoneSet, req *dns.Msg, name string) *dns.Msg {
+	if r == nil {
+		return nil
+	}
+
+	texts := r.lookup(name)
+	if len(texts) == 0 {
+		return nil
+	}
+
+	found := set.served(name)
+	if found == nil {
+		return nil
+	}
+
+	resp := newResponse(req)
+	resp.Authoritative = true
+
+	switch req.Question[0].Qtype {
+	case dns.TypeTXT, dns.TypeANY:
+		ttl := max(time.Duration(set.cfg.Expire), time.Second)
+		for _, text := range texts {
+			resp.Answer = append(resp.Answer, &dns.TXT{
+				Hdr: zoneRRHeader(req.Question[0].Name, dns.TypeTXT, ttl),
+				Txt: []string{text},
+			})
+		}
+	default:
+		// The name exists, but has no records of this type.
+		zone := found.Zone
+		if err := zone.Validate(); err != nil {
+			return nil
+		}
+		resp.Ns = []dns.RR{zoneSOA(zone, set.serial)}
+	}
+
+	return resp
+}
+
+// acmeRequest is the body of requests to the API. It is the same as the
+// httpreq provider of lego sends.
+type acmeRequest struct {
+	FQDN  string `json:"fqdn"`
+	Value string `json:"value"`
+}
+
+// acmeHandler serves the API that sets the challenge records of store:
+//
+//   - POST /acme/present adds the value to the TXT records of the name.
+//   - POST /acme/cleanup removes the value, or all values if it is empty.
+//
+// Only names that start with "_acme-challenge." within the served zones may
+// be set.
+func acmeHandler(store *zoneStore, token string) http.Handler {
+	mux := http.NewServeMux()
+	handle := func(pattern string, needsValue bool, fn func(name, value string)) {
+		mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+			if !tokenAuthorized(r, token) {
+				w.Header().Set("WWW-Authenticate", `Basic realm="cname-serve"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			var req acmeRequest
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+				http.Error(w, "invalid request body", http.StatusBadRequest)
+				return
+			}
+
+			if !newdns.IsDomain(req.FQDN, false) {
+				http.Error(w, "invalid fqdn", http.StatusBadRequest)
+				return
+			}
+			name := newdns.NormalizeDomain(req.FQDN, true, true, false)
+			if !strings.HasPrefix(name, "_acme-challenge.") || store.Zones().served(name) == nil {
+				http.Error(w, "fqdn is not an ACME challenge within the zones", http.StatusUnprocessableEntity)
+				return
+			}
+			if needsValue && req.Value == "" {
+				http.Error(w, "missing value", http.StatusBadRequest)
+				return
+			}
+			if len(req.Value) > 255 {
+				http.Error(w, "value is too long", http.StatusBadRequest)
+				return
+			}
+
+			fn(name, req.Value)
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+
+	handle("POST /acme/present", true, func(name, value string) {
+		store.acme.present(name, value)
+		slog.Info(
+			"presenting ACME challenge",
+			"name", name)
+	})
+	handle("POST /acme/cleanup", false, func(name, value string) {
+		store.acme.cleanup(name, value)
+		slog.Info(
+			"cleaned up ACME challenge",
+			"name", name)
+	})
+
+	return mux
+}
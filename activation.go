@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd socket
+// activation.
+const listenFDsStart = 3
+
+// activatedSockets holds the sockets that were passed to us by systemd socket
+// activation.
+type activatedSockets struct {
+	packetConns []net.PacketConn
+	listeners   []net.Listener
+}
+
+func (s activatedSockets) empty() bool {
+	return len(s.packetConns) == 0 && len(s.listeners) == 0
+}
+
+// listenFDs returns the sockets passed by systemd socket activation like
+// sd_listen_fds(3). Datagram sockets are served as UDP and stream sockets as
+// TCP. It returns no sockets if the process was not socket-activated.
+func listenFDs() (activatedSockets, error) {
+	var sockets activatedSockets
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return sockets, nil
+	}
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return sockets, fmt.Errorf("invalid $LISTEN_FDS: %w", err)
+	}
+
+	// Don't pass the sockets on to child processes.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	for fd := listenFDsStart; fd < listenFDsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+
+		// Both of these duplicate the file descriptor.
+		if l, err := net.FileListener(f); err == nil {
+			sockets.listeners = append(sockets.listeners, l)
+		} else if conn, err := net.FilePacketConn(f); err == nil {
+			sockets.packetConns = append(sockets.packetConns, conn)
+		} else {
+			f.Close()
+			return sockets, fmt.Errorf("failed to use activated socket %d: %w", fd, err)
+		}
+		f.Close()
+	}
+
+	return sockets, nil
+}
+
+// checkListenFDsOnly returns an error if the config makes us open sockets to
+// listen on besides the activated ones, which listen_fds_only forbids.
+func checkListenFDsOnly(cfg *Config) error {
+	switch {
+	case cfg.Tailscale.Enable:
+		return fmt.Errorf("tailscale listens on its own sockets")
+	case cfg.DoQAddr != "":
+		return fmt.Errorf("doq_addr is set")
+	case cfg.HTTPAddr != "":
+		return fmt.Errorf("http_addr is set")
+	case cfg.Admin.Addr != "":
+		return fmt.Errorf("admin.addr is set")
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// AdminConfig configures the admin API, which is a JSON HTTP API on its own
+// listener for control planes.
+type AdminConfig struct {
+	// Addr is the address to listen on. The API is disabled if this is empty.
+	Addr string `toml:"addr"`
+	// Token authenticates requests as a bearer token or as the password of
+	// basic auth. It is required and may also be a secret reference, see
+	// [resolveSecret].
+	Token string `toml:"token"`
+	// Allow are the networks that may access the API. Defaults to loopback.
+	Allow []netip.Prefix `toml:"allow"`
+}
+
+// loadToken returns the token, resolving it if it is a secret reference. A
+// secret that resolves to nothing is an error, since it would let requests
+// with an empty token through.
+func (c AdminConfig) loadToken(ctx context.Context) (string, error) {
+	if !isSecretURI(c.Token) {
+		return c.Token, nil
+	}
+	v, err := resolveSecret(ctx, c.Token)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(v))
+	if token == "" {
+		return "", fmt.Errorf("secret %s is empty", c.Token)
+	}
+	return token, nil
+}
+
+// adminHandler serves the admin API on top of the store:
+//
+//   - GET /config returns a summary of the config like at startup.
+//   - GET /stats returns the query counts of the zones, the cache stats and the
+//     latencies of the fallback pool.
+//   - POST /reload reloads the config file at path like SIGHUP does.
+//
+// listeners are listed in the summary, and the latencies of the servers of
+// pool, if not nil, are part of the stats.
+func adminHandler(store *zoneStore, pool *fallbackPool, path, token string, listeners []string) http.Handler {
+	writeJSON := func(w http.ResponseWriter, code int, v any) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(v)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /config", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, newConfigSummary(store.Zones(), listeners))
+	})
+	mux.HandleFunc("GET /stats", func(w http.ResponseWriter, r *http.Request) {
+		cache := store.Zones().cache
+		zones, fallback := store.stats.snapshot()
+		writeJSON(w, http.StatusOK, map[string]any{
+			"queries":          zones,
+			"fallback_queries": fallback,
+			"cache": map[string]any{
+				"entries":   cache.len(),
+				"hits":      cache.hits.Load(),
+				"misses":    cache.misses.Load(),
+				"evictions": cache.evictions.Load(),
+			},
+			"target_changes": store.opts.TargetDrift.changes.Load(),
+			"fallback_pool":  pool.stats(),
+		})
+	})
+	mux.HandleFunc("POST /reload", func(w http.ResponseWriter, r *http.Request) {
+		diff, err := reload(store, path)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		changes := map[string][]string{
+			"zones_added":   diff.zonesAdded,
+			"zones_removed": diff.zonesRemoved,
+			"names_added":   diff.namesAdded,
+			"names_removed": diff.namesRemoved,
+			"names_changed": diff.namesChanged,
+		}
+		for k, v := range changes {
+			if v == nil {
+				// Encode as [] instead of null.
+				changes[k] = []string{}
+			}
+		}
+		writeJSON(w, http.StatusOK, changes)
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !tokenAuthorized(r, token) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="cname-serve"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// serveAdmin serves the admin API until the context is canceled, then waits
+// for up to 5 seconds for in-flight requests such as reloads to complete.
+func serveAdmin(ctx context.Context, lc *net.ListenConfig, cfg AdminConfig, h http.Handler) error {
+	l, err := lc.Listen(ctx, "tcp", cfg.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen to admin API: %w", err)
+	}
+
+	srv := &http.Server{
+		Handler:           allowHTTPHandler(h, cfg.Allow),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}()
+
+	if err := srv.Serve(l); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
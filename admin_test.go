@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTokenAuthorized(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		token  string
+		want   bool
+	}{
+		{"bearer", "Bearer secret", "secret", true},
+		{"basic", "Basic OnNlY3JldA==", "secret", true},
+		{"wrong", "Bearer wrong", "secret", false},
+		{"missing", "", "secret", false},
+		{"empty bearer", "Bearer ", "", false},
+		{"empty basic", "Basic Og==", "", false},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/stats", nil)
+		if test.header != "" {
+			r.Header.Set("Authorization", test.header)
+		}
+		if got := tokenAuthorized(r, test.token); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestLoadTokenEmpty(t *testing.T) {
+	t.Setenv("CNAME_SERVE_TEST_TOKEN", " \n")
+
+	_, err := AdminConfig{Token: "env://CNAME_SERVE_TEST_TOKEN"}.loadToken(context.Background())
+	if err == nil {
+		t.Error("loading an empty token succeeded")
+	}
+}
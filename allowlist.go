@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/256dpi/newdns"
+	"github.com/miekg/dns"
+)
+
+// AllowlistConfig restricts the names that are answered at all. If any names
+// are set, queries for all other names are refused, even if a zone or the
+// fallback would answer them.
+type AllowlistConfig struct {
+	// Names are the allowed names. Names that start with "*." allow all names
+	// below them, but not the name itself.
+	Names []string `toml:"names"`
+	// File is a file of more names, one per line. Lines that start with "#"
+	// are ignored. It is read again on reload.
+	File string `toml:"file"`
+
+	// names holds the normalized Names and the names of File.
+	names map[string]bool
+}
+
+// load reads File and normalizes all names.
+func (c *AllowlistConfig) load() error {
+	names := c.Names
+	if c.File != "" {
+		fileNames, err := readAllowlistFile(c.File)
+		if err != nil {
+			return err
+		}
+		names = slices.Concat(names, fileNames)
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	c.names = make(map[string]bool, len(names))
+	for _, name := range names {
+		bare := strings.TrimPrefix(name, "*.")
+		if !newdns.IsDomain(bare, false) {
+			return fmt.Errorf("invalid name %q in allowlist", name)
+		}
+		normalized := newdns.NormalizeDomain(bare, true, true, false)
+		if bare != name {
+			normalized = "*." + normalized
+		}
+		c.names[normalized] = true
+	}
+	return nil
+}
+
+func readAllowlistFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open allowlist file: %w", err)
+	}
+	defer f.Close()
+
+	var names []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		names = append(names, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read allowlist file: %w", err)
+	}
+	return names, nil
+}
+
+// allows returns whether the normalized name may be answered. All names are
+// allowed if the allowlist is empty.
+func (c *AllowlistConfig) allows(name string) bool {
+	if c.names == nil || c.names[name] {
+		return true
+	}
+	for parent := name; parent != ""; {
+		_, parent, _ = strings.Cut(parent, ".")
+		if c.names["*."+parent] {
+			return true
+		}
+	}
+	return false
+}
+
+// allowlistHandler refuses queries for names that are not on the allowlist
+// and hands all others to h.
+func allowlistHandler(store *zoneStore, h dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		set := store.Zones()
+		name := newdns.NormalizeDomain(req.Question[0].Name, true, true, false)
+		if set.cfg.Allowlist.allows(name) {
+			h.ServeDNS(w, req)
+			return
+		}
+
+		slog.Debug(
+			"refusing query for name that is not on the allowlist",
+			"client", clientAddr(w),
+			"name", name)
+
+		w.WriteMsg(errorResponse(req, dns.RcodeRefused, dns.ExtendedErrorCodeProhibited, "name not allowed"))
+	})
+}
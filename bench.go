@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/pflag"
+)
+
+// runBench sends queries for the given names to a DNS server as fast as
+// possible and prints throughput and latency statistics.
+func runBench(ctx context.Context, args []string) int {
+	flags := pflag.NewFlagSet("bench", pflag.ContinueOnError)
+	addr := flags.StringP("addr", "a", "127.0.0.1:53", "address of the DNS server to benchmark")
+	concurrency := flags.IntP("concurrency", "n", 10, "number of concurrent queries")
+	duration := flags.DurationP("duration", "d", 10*time.Second, "how long to run for")
+	timeout := flags.Duration("timeout", 2*time.Second, "timeout of every query")
+	qtypeName := flags.StringP("type", "t", "A", "type of the queries")
+	network := flags.String("net", "udp", "network to use, either udp or tcp")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	names := flags.Args()
+	if len(names) == 0 {
+		slog.Error(
+			"no names given to query, usage: cname-serve bench [flags] name...")
+		return 2
+	}
+
+	qtype, ok := dns.StringToType[*qtypeName]
+	if !ok {
+		slog.Error(
+			"unknown query type",
+			"type", *qtypeName)
+		return 2
+	}
+
+	slog.Info(
+		"benchmark starting",
+		"addr", *addr,
+		"names", names,
+		"concurrency", *concurrency,
+		"duration", *duration)
+
+	ctx, cancel := context.WithTimeout(ctx, *duration)
+	defer cancel()
+
+	var (
+		mu      sync.Mutex
+		results benchResults
+		wg      sync.WaitGroup
+	)
+
+	start := time.Now()
+	for i := range *concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			client := &dns.Client{Net: *network, Timeout: *timeout}
+			var r benchResults
+			var conn *dns.Conn
+
+			for j := i; ctx.Err() == nil; j++ {
+				// Reuse the connection like a resolver would, and only
+				// reconnect after errors.
+				if conn == nil {
+					var err error
+					if conn, err = client.Dial(*addr); err != nil {
+						r.add(nil, 0, err)
+						continue
+					}
+				}
+
+				req := new(dns.Msg)
+				req.SetQuestion(dns.Fqdn(names[j%len(names)]), qtype)
+
+				// Don't use ctx for the exchange itself, so that queries are
+				// only bounded by the timeout and the last ones are not
+				// counted as failed.
+				resp, rtt, err := client.ExchangeWithConn(req, conn)
+				if ctx.Err() != nil {
+					break
+				}
+
+				if err != nil {
+					conn.Close()
+					conn = nil
+
+					// Servers close TCP connections after a number of
+					// queries, which is not a failure.
+					if errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET) {
+						continue
+					}
+				}
+
+				r.add(resp, rtt, err)
+			}
+			if conn != nil {
+				conn.Close()
+			}
+
+			mu.Lock()
+			results.merge(r)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	results.print(time.Since(start))
+	return 0
+}
+
+type benchResults struct {
+	latencies []time.Duration
+	rcodes    map[int]int
+	timeouts  int
+	errors    int
+}
+
+func (r *benchResults) add(resp *dns.Msg, rtt time.Duration, err error) {
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		r.timeouts++
+	case err != nil:
+		r.errors++
+	default:
+		if r.rcodes == nil {
+			r.rcodes = make(map[int]int)
+		}
+		r.rcodes[resp.Rcode]++
+		r.latencies = append(r.latencies, rtt)
+	}
+}
+
+func (r *benchResults) merge(other benchResults) {
+	r.latencies = append(r.latencies, other.latencies...)
+	r.timeouts += other.timeouts
+	r.errors += other.errors
+	for rcode, n := range other.rcodes {
+		if r.rcodes == nil {
+			r.rcodes = make(map[int]int)
+		}
+		r.rcodes[rcode] += n
+	}
+}
+
+func (r *benchResults) print(elapsed time.Duration) {
+	slices.Sort(r.latencies)
+
+	percentile := func(p float64) time.Duration {
+		if len(r.latencies) == 0 {
+			return 0
+		}
+		return r.latencies[int(float64(len(r.latencies)-1)*p)]
+	}
+
+	fmt.Printf("responses: %d in %s (%.1f queries/s)\n",
+		len(r.latencies), elapsed.Round(time.Millisecond), float64(len(r.latencies))/elapsed.Seconds())
+	fmt.Printf("latency:   p50 %s, p90 %s, p99 %s, max %s\n",
+		percentile(0.50), percentile(0.90), percentile(0.99), percentile(1))
+	for _, rcode := range slices.Sorted(maps.Keys(r.rcodes)) {
+		fmt.Printf("rcode:     %s: %d\n", dns.RcodeToString[rcode], r.rcodes[rcode])
+	}
+	fmt.Printf("timeouts:  %d\n", r.timeouts)
+	fmt.Printf("errors:    %d\n", r.errors)
+}
@@ -0,0 +1,18 @@
+package main
+
+import "syscall"
+
+// bindDeviceControl returns a [net.ListenConfig] Control function that binds
+// sockets to the given network interface using SO_BINDTODEVICE.
+func bindDeviceControl(device string) (func(network, address string, c syscall.RawConn) error, error) {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = syscall.BindToDevice(int(fd), device)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}, nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+func bindDeviceControl(device string) (func(network, address string, c syscall.RawConn) error, error) {
+	return nil, errors.New("bind_device is only supported on Linux")
+}
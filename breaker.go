@@ -0,0 +1,98 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// circuitBreaker stops sending queries to an upstream after it failed too
+// many times in a row, so that queries fail fast instead of all waiting for
+// timeouts. After a cooldown, a single query is let through to probe whether
+// the upstream has recovered.
+type circuitBreaker struct {
+	addr string
+	cfg  CircuitBreakerConfig
+
+	mu           sync.Mutex
+	failures     int
+	firstFailure time.Time
+	openUntil    time.Time // zero if closed
+	probing      bool
+}
+
+func newCircuitBreaker(addr string, cfg CircuitBreakerConfig) *circuitBreaker {
+	return &circuitBreaker{addr: addr, cfg: cfg}
+}
+
+// Allow returns whether a query may be sent to the upstream. If it returns
+// true, then Done must be called with the result of the query.
+func (b *circuitBreaker) Allow() bool {
+	if b.cfg.Failures <= 0 {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch {
+	case b.openUntil.IsZero():
+		return true
+	case b.probing || time.Now().Before(b.openUntil):
+		return false
+	default:
+		b.probing = true
+		return true
+	}
+}
+
+// Done records the result of a query that was allowed.
+func (b *circuitBreaker) Done(err error) {
+	if b.cfg.Failures <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+
+	if err == nil {
+		if !b.openUntil.IsZero() {
+			slog.Info(
+				"upstream recovered, closing circuit breaker",
+				"upstream", b.addr)
+		}
+		b.failures = 0
+		b.openUntil = time.Time{}
+		b.probing = false
+		return
+	}
+
+	if b.probing {
+		b.probing = false
+		b.openUntil = now.Add(time.Duration(b.cfg.Cooldown))
+		slog.Warn(
+			"upstream is still failing, keeping circuit breaker open",
+			"upstream", b.addr,
+			"cooldown", time.Duration(b.cfg.Cooldown),
+			"err", err)
+		return
+	}
+
+	if b.failures == 0 || now.Sub(b.firstFailure) > time.Duration(b.cfg.Window) {
+		b.failures = 0
+		b.firstFailure = now
+	}
+	b.failures++
+
+	if b.failures >= b.cfg.Failures && b.openUntil.IsZero() {
+		b.openUntil = now.Add(time.Duration(b.cfg.Cooldown))
+		slog.Warn(
+			"upstream is failing, opening circuit breaker",
+			"upstream", b.addr,
+			"failures", b.failures,
+			"cooldown", time.Duration(b.cfg.Cooldown),
+			"err", err)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// resolveCacheRefreshFloor is the remaining lifetime below which cached
+// addresses are refreshed in the background while still being served.
+const resolveCacheRefreshFloor = time.Second
+
+// resolveCache resolves targets for finalize and caches their addresses, so
+// that targets are not resolved on every query. Addresses from the cache are
+// served with the remaining lifetime of their entry as their TTL, so that
+// clients don't cache them for longer than we do.
+type resolveCache struct {
+	ctx      context.Context
+	resolver ipResolver
+	ttl      time.Duration
+	// jitter is the ttl_jitter that ttl is changed by for every entry.
+	jitter float64
+	// maxEntries, if not 0, is the most targets that are cached. The least
+	// recently used ones are evicted beyond it.
+	maxEntries int
+	// shared, if not nil, shares the addresses with other replicas.
+	shared *redisCache
+	// drift, if not nil, is told about every resolution of a target.
+	drift *targetDrift
+
+	*resolveCacheEntries
+}
+
+// resolveCacheEntries are the cached addresses of a resolveCache and its
+// stats. They are kept across rebuilds of the zones, which only change the
+// settings of the cache.
+type resolveCacheEntries struct {
+	mu      sync.Mutex
+	entries map[resolveCacheKey]*list.Element // of *resolveCacheEntry
+	lru     *list.List                        // most recently used first
+
+	// hits and misses count the lookups that were or were not answered from
+	// the cache, and evictions the entries that were evicted for maxEntries.
+	hits, misses, evictions atomic.Uint64
+}
+
+func newResolveCacheEntries() *resolveCacheEntries {
+	return &resolveCacheEntries{
+		entries: make(map[resolveCacheKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+type resolveCacheKey struct {
+	target  string
+	network string
+}
+
+type resolveCacheEntry struct {
+	key        resolveCacheKey
+	ips        []net.IP
+	expires    time.Time
+	refreshing bool
+}
+
+// newResolveCache creates a cache that resolves targets using resolver and
+// keeps their addresses for ttl, changed by up to the fraction jitter of it so
+// that entries are not all refreshed at once. If ttl is 0, then targets are
+// resolved on every lookup. If maxEntries is not 0, then at most that many
+// targets are cached. ctx is used for refreshing entries in the background.
+// drift, if not nil, is told about the addresses of every resolution. The
+// addresses are kept in entries, or in new entries if it is nil.
+func newResolveCache(ctx context.Context, resolver ipResolver, ttl time.Duration, jitter float64, maxEntries int, shared *redisCache, drift *targetDrift, entries *resolveCacheEntries) *resolveCache {
+	if entries == nil {
+		entries = newResolveCacheEntries()
+	}
+	return &resolveCache{
+		ctx:                 ctx,
+		resolver:            resolver,
+		ttl:                 ttl,
+		jitter:              jitter,
+		maxEntries:          maxEntries,
+		shared:              shared,
+		drift:               drift,
+		resolveCacheEntries: entries,
+	}
+}
+
+// lookupIP resolves the target like nameTarget.lookupIP. If the addresses are
+// cached, then expires is when they stop being valid. Otherwise, it is zero.
+func (c *resolveCache) lookupIP(ctx context.Context, t *nameTarget, network string) (ips []net.IP, expires time.Time, err error) {
+	if t.addr.IsValid() {
+		ips, err := t.lookupIP(ctx, c.resolver, network)
+		return ips, time.Time{}, err
+	}
+	if c.ttl <= 0 {
+		ips, err := c.resolve(ctx, t, network)
+		return ips, time.Time{}, err
+	}
+
+	key := resolveCacheKey{target: t.target, network: network}
+	now := time.Now()
+
+	c.mu.Lock()
+	if elem, ok := c.entries[key]; ok && now.Before(elem.Value.(*resolveCacheEntry).expires) {
+		c.lru.MoveToFront(elem)
+		e := elem.Value.(*resolveCacheEntry)
+		if e.expires.Sub(now) < resolveCacheRefreshFloor && !e.refreshing {
+			e.refreshing = true
+			go c.refresh(key, t)
+		}
+		ips, expires := e.ips, e.expires
+		c.mu.Unlock()
+		c.hits.Add(1)
+		return ips, expires, nil
+	}
+	c.mu.Unlock()
+	c.misses.Add(1)
+
+	if c.shared != nil {
+		ips, expires, err := c.shared.get(ctx, key)
+		if err != nil {
+			slog.Debug(
+				"failed to get target from redis",
+				"target", key.target,
+				"err", err)
+		} else if len(ips) > 0 && now.Before(expires) {
+			c.storeUntil(key, ips, expires)
+			return ips, expires, nil
+		}
+	}
+
+	ips, err = t.lookupIP(ctx, c.resolver, network)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return ips, c.store(ctx, key, ips), nil
+}
+
+// resolve resolves the target without caching its addresses, for targets that
+// are resolved on every query. drift is still told about the addresses.
+func (c *resolveCache) resolve(ctx context.Context, t *nameTarget, network string) ([]net.IP, error) {
+	ips, err := t.lookupIP(ctx, c.resolver, network)
+	if err == nil && !t.addr.IsValid() {
+		c.drift.observe(resolveCacheKey{target: t.target, network: network}, ips, c.maxEntries)
+	}
+	return ips, err
+}
+
+// len returns the number of cached targets, including expired ones.
+func (c *resolveCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// forget drops the cached addresses of the targets, such as once they are no
+// longer served.
+func (c *resolveCache) forget(targets map[string]bool) {
+	if len(targets) == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, elem := range c.entries {
+		if targets[key.target] {
+			c.lru.Remove(elem)
+			delete(c.entries, key)
+			c.drift.forget(key)
+		}
+	}
+}
+
+func (c *resolveCache) refresh(key resolveCacheKey, t *nameTarget) {
+	ctx, cancel := context.WithTimeout(c.ctx, 10*time.Second)
+	defer cancel()
+
+	ips, err := t.lookupIP(ctx, c.resolver, key.network)
+	if err != nil {
+		slog.Debug(
+			"failed to refresh cached target",
+			"target", key.target,
+			"err", err)
+
+		c.mu.Lock()
+		if elem, ok := c.entries[key]; ok {
+			elem.Value.(*resolveCacheEntry).refreshing = false
+		}
+		c.mu.Unlock()
+		return
+	}
+
+	c.store(ctx, key, ips)
+}
+
+// store caches freshly resolved addresses for the TTL of the cache.
+func (c *resolveCache) store(ctx context.Context, key resolveCacheKey, ips []net.IP) time.Time {
+	expires := time.Now().Add(jitterTTL(c.ttl, c.jitter))
+	c.storeUntil(key, ips, expires)
+	c.drift.observe(key, ips, c.maxEntries)
+
+	if c.shared != nil {
+		if err := c.shared.set(ctx, key, ips, expires); err != nil {
+			slog.Debug(
+				"failed to store target in redis",
+				"target", key.target,
+				"err", err)
+		}
+	}
+
+	return expires
+}
+
+func (c *resolveCache) storeUntil(key resolveCacheKey, ips []net.IP, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &resolveCacheEntry{key: key, ips: ips, expires: expires}
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+
+	for c.maxEntries > 0 && c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Remove(c.lru.Back()).(*resolveCacheEntry)
+		delete(c.entries, oldest.key)
+		c.evictions.Add(1)
+	}
+}
@@ -1,29 +1,530 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/hex"
 	"fmt"
 	"log/slog"
+	"maps"
+	"math"
+	"net/netip"
 	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
 	"time"
 
+	"github.com/256dpi/newdns"
+	"github.com/miekg/dns"
 	"github.com/pelletier/go-toml/v2"
 )
 
+// configVersion is the latest version of the config file format.
+const configVersion = 1
+
 type Config struct {
-	Addr        string                `toml:"addr"`
-	Expire      tomlDuration          `toml:"expire"`
-	FallbackDNS string                `toml:"fallback_dns"`
-	Finalize    bool                  `toml:"finalize"`
-	Tailscale   TailscaleConfig       `toml:"tailscale"`
-	Zones       map[string]ZoneConfig `toml:"zones"`
+	Version           int                    `toml:"version"`
+	Addr              string                 `toml:"addr"`
+	Allow             []netip.Prefix         `toml:"allow"`
+	AnswerOrder       string                 `toml:"answer_order"`
+	AuthoritativeOnly bool                   `toml:"authoritative_only"`
+	BindDevice        string                 `toml:"bind_device"`
+	BindRetries       int                    `toml:"bind_retries"`
+	CacheMaxEntries   int                    `toml:"cache_max_entries"`
+	DnstapSocket      string                 `toml:"dnstap_socket"`
+	DoQAddr           string                 `toml:"doq_addr"`
+	DropUnauthorized  bool                   `toml:"drop_unauthorized"`
+	DSCP              int                    `toml:"dscp"`
+	Expire            tomlDuration           `toml:"expire"`
+	FallbackDNS       string                 `toml:"fallback_dns"`
+	FallbackSource    netip.Addr             `toml:"fallback_source_addr"`
+	FastAAAANoData    bool                   `toml:"fast_aaaa_nodata"`
+	Finalize          bool                   `toml:"finalize"`
+	FinalizeCacheTTL  tomlDuration           `toml:"finalize_cache_ttl"`
+	FinalizeRedis     *RedisConfig           `toml:"finalize_cache_redis"`
+	FinalizeFamily    addrFamily             `toml:"finalize_family"`
+	FinalizeQtypes    []string               `toml:"finalize_qtypes"`
+	FinalizeResolver  string                 `toml:"finalize_resolver"`
+	FinalizeFallback  bool                   `toml:"finalize_via_fallback"`
+	FinalizeConns     int                    `toml:"finalize_resolver_conns"`
+	HostsFile         string                 `toml:"hosts_file"`
+	HTTPAddr          string                 `toml:"http_addr"`
+	HTTPAllow         []netip.Prefix         `toml:"http_allow"`
+	IncludeTargetA    bool                   `toml:"include_target_a"`
+	IncludeExternalA  bool                   `toml:"include_external_target_a"`
+	ListenFDsOnly     bool                   `toml:"listen_fds_only"`
+	LookupTimeout     tomlDuration           `toml:"lookup_timeout"`
+	MalformedQueries  string                 `toml:"malformed_queries"`
+	MaxCNAMEDepth     int                    `toml:"max_cname_depth"`
+	MaxMessageSize    int                    `toml:"max_message_size"`
+	MaxNames          int                    `toml:"max_names"`
+	MaxTCPConnections int                    `toml:"max_tcp_connections"`
+	MaxZones          int                    `toml:"max_zones"`
+	MinimalResponses  bool                   `toml:"minimal_responses"`
+	MinTTL            typeTTLs               `toml:"min_ttl"`
+	NegativeTTL       tomlDuration           `toml:"negative_ttl"`
+	PadResponses      bool                   `toml:"pad_responses"`
+	PaddingBlockSize  int                    `toml:"padding_block_size"`
+	RecursionAllow    []netip.Prefix         `toml:"recursion_allow"`
+	ReportTargetDrift bool                   `toml:"report_target_drift"`
+	ReversePTR        bool                   `toml:"reverse_ptr"`
+	RootQueries       string                 `toml:"root_queries"`
+	Serial            string                 `toml:"serial"`
+	SerialFile        string                 `toml:"serial_file"`
+	ShuffleAnswers    bool                   `toml:"shuffle_answers"`
+	ShufflePerClient  bool                   `toml:"shuffle_per_client"`
+	SOAMName          string                 `toml:"soa_mname"`
+	SOARName          string                 `toml:"soa_rname"`
+	SuppressTypes     clientTypes            `toml:"suppress_types"`
+	TCPIdleTimeout    tomlDuration           `toml:"tcp_idle_timeout"`
+	TTLJitter         float64                `toml:"ttl_jitter"`
+	Truncation        string                 `toml:"truncation"`
+	Use0x20           bool                   `toml:"use_0x20"`
+	ACME              ACMEConfig             `toml:"acme"`
+	Admin             AdminConfig            `toml:"admin"`
+	Allowlist         AllowlistConfig        `toml:"allowlist"`
+	Backend           BackendConfig          `toml:"backend"`
+	Debug             DebugConfig            `toml:"debug"`
+	FallbackBreaker   CircuitBreakerConfig   `toml:"fallback_breaker"`
+	FallbackPool      FallbackPoolConfig     `toml:"fallback_pool"`
+	HealthCheck       HealthCheckConfig      `toml:"health_check"`
+	StatsTXT          StatsTXTConfig         `toml:"stats_txt"`
+	TLS               TLSConfig              `toml:"tls"`
+	Tailscale         TailscaleConfig        `toml:"tailscale"`
+	Vars              map[string]string      `toml:"vars"`
+	ZoneOptions       map[string]ZoneOptions `toml:"zone_options"`
+	Zones             map[string]ZoneConfig  `toml:"-"`
+}
+
+// ZoneOptions are options that apply to a whole zone.
+type ZoneOptions struct {
+	// ForwardTo, if set, is the DNS server that queries for names that are not
+	// in the zone are forwarded to instead of fallback_dns.
+	ForwardTo string `toml:"forward_to"`
+	// Allow, if not empty, restricts the clients that may query the zone in
+	// addition to the global allow.
+	Allow []netip.Prefix `toml:"allow"`
+	// Rewrite computes the targets of names that have no entry in the zone.
+	// The first matching rule is used.
+	Rewrite []RewriteRule `toml:"rewrite"`
+	// HideCNAME serves all names of the zone as their addresses, so that the
+	// names of the targets are never revealed to clients.
+	HideCNAME bool `toml:"hide_cname"`
+	// TargetSuffix is appended to the targets of the zone that are not fully
+	// qualified, i.e. that don't end with a dot.
+	TargetSuffix string `toml:"target_suffix"`
+	// SOAMName and SOARName override soa_mname and soa_rname for the zone.
+	SOAMName string `toml:"soa_mname"`
+	SOARName string `toml:"soa_rname"`
+	// UnmatchedNoData answers names that have no entry in the zone with
+	// NODATA instead of NXDOMAIN, so that resolvers don't cache that they
+	// don't exist. They are then never forwarded.
+	UnmatchedNoData bool `toml:"unmatched_nodata"`
+	// QueryLog logs every query for the zone and its response, see
+	// [queryLogHandler].
+	QueryLog bool `toml:"query_log"`
+	// Defaults apply to every entry of the zone that does not set them.
+	Defaults ZoneDefaults `toml:"defaults"`
+}
+
+// ZoneDefaults are the defaults of the entries of a zone. An option is taken
+// from the entry if it sets it, then from these defaults, and then from the
+// global options.
+type ZoneDefaults struct {
+	// TTL overrides expire.
+	TTL *tomlDuration `toml:"ttl"`
+	// Finalize overrides finalize.
+	Finalize *bool `toml:"finalize"`
+	// NoCache overrides no_cache of entries, see [ZoneEntry.NoCache].
+	NoCache *bool `toml:"no_cache"`
+	// As is the as of entries, see [ZoneEntry.As]. At the zone apex, "cname"
+	// is served like "alias".
+	As string `toml:"as"`
+}
+
+// as returns how an entry of the zone that is configured to be served as as
+// is served.
+func (o ZoneOptions) as(as string) string {
+	if o.HideCNAME && as != entryAsA {
+		return entryAsAlias
+	}
+	return as
+}
+
+// qualify appends the target suffix of the zone to target unless it is
+// fully qualified or an address.
+func (o ZoneOptions) qualify(target string) string {
+	if o.TargetSuffix == "" || dns.IsFqdn(target) {
+		return target
+	}
+	if _, err := netip.ParseAddr(target); err == nil {
+		return target
+	}
+	return target + "." + o.TargetSuffix
+}
+
+// RewriteRule maps names within a zone that match a regular expression to a
+// target.
+type RewriteRule struct {
+	// Match must match the whole name relative to the zone.
+	Match tomlRegexp `toml:"match"`
+	// Replace is the target, which may refer to capture groups of Match as
+	// $1 or ${name}.
+	Replace string `toml:"replace"`
+}
+
+type ZoneConfig map[string]ZoneEntry // name -> entry
+
+// Values of ZoneEntry.As.
+const (
+	// entryAsCNAME serves a CNAME to one of the targets.
+	entryAsCNAME = "cname"
+	// entryAsA serves the resolved IPv4 addresses of the targets as A records.
+	entryAsA = "a"
+	// entryAsAlias serves the resolved addresses of the targets as A and AAAA
+	// records, like an ALIAS record. This is what finalize does.
+	entryAsAlias = "alias"
+)
+
+// finalizesQtype returns whether finalize applies to queries of the given type.
+// A qtype of 0 means that the type is unknown, to which finalize applies.
+func (c *Config) finalizesQtype(qtype uint16) bool {
+	if qtype == 0 || len(c.FinalizeQtypes) == 0 {
+		return true
+	}
+	return slices.Contains(c.FinalizeQtypes, dns.TypeToString[qtype])
+}
+
+// typeTTLs maps record types such as "NS" to TTLs.
+type typeTTLs map[string]tomlDuration
+
+// minTTL returns the lowest TTL that records of the type are served with, or 0
+// if there is none.
+func (c *Config) minTTL(rrtype uint16) time.Duration {
+	return time.Duration(c.MinTTL[dns.TypeToString[rrtype]])
+}
+
+// clientTypes maps networks of clients such as "10.0.0.0/8" to record types
+// such as AAAA.
+type clientTypes map[netip.Prefix][]uint16
+
+// suppressedTypes returns the record types that are left out of the responses
+// to the client, or nil if there are none.
+func (c *Config) suppressedTypes(client netip.Addr) []uint16 {
+	var types []uint16
+	for prefix, rrtypes := range c.SuppressTypes {
+		if prefix.Contains(client) {
+			types = append(types, rrtypes...)
+		}
+	}
+	return types
+}
+
+// addrFamily is the address family of resolved targets that are served.
+type addrFamily string
+
+const (
+	familyBoth addrFamily = "both"
+	familyIPv4 addrFamily = "ipv4"
+	familyIPv6 addrFamily = "ipv6"
+)
+
+// network returns the network name for [net.Resolver.LookupIP].
+func (f addrFamily) network() string {
+	switch f {
+	case familyIPv4:
+		return "ip4"
+	case familyIPv6:
+		return "ip6"
+	default:
+		return "ip"
+	}
+}
+
+// ZoneEntry describes what a single name within a zone points to. In the
+// config file, it is either a target string or a table.
+type ZoneEntry struct {
+	Target  string         `toml:"target"`
+	Targets []TargetConfig `toml:"targets"`
+	// As overrides how the targets are served regardless of finalize. It is
+	// one of the entryAs constants.
+	As string `toml:"as"`
+	// Rcode, if set, is the response code such as "REFUSED" or "NXDOMAIN"
+	// that the name is answered with instead of any targets.
+	Rcode string `toml:"rcode"`
+	// LOC, if set, is the location that the name is served as a LOC record
+	// instead of any targets.
+	LOC *LOCConfig `toml:"loc"`
+	// DNAME, if set, is the domain that the whole subtree below the name is
+	// aliased to with a DNAME record (RFC 6672) instead of any targets.
+	DNAME string `toml:"dname"`
+	// DS are the DS records (RFC 4034) of a signed zone that is delegated at
+	// the name, which are served instead of any targets.
+	DS []DSConfig `toml:"ds"`
+	// TXT are static TXT records that are served next to the targets, such as
+	// for domain verification. A name may also only have TXT records.
+	TXT []string `toml:"txt"`
+	// MX are static MX records that are served next to the targets, such as
+	// for the mail servers of the zone apex.
+	MX []MXConfig `toml:"mx"`
+	// Schedule switches the name to other targets during time windows. The
+	// first active window is used.
+	Schedule []ScheduleConfig `toml:"schedule"`
+	// TTL, if set, overrides expire for the records of the name. It may be 0
+	// so that clients don't cache the records at all.
+	TTL *tomlDuration `toml:"ttl"`
+	// Finalize, if set, overrides finalize for the name. It has no effect if
+	// As is set.
+	Finalize *bool `toml:"finalize"`
+	// NoCache, if true, resolves the targets of the name on every query
+	// instead of caching them for finalize_cache_ttl, for targets whose
+	// addresses change too often to be cached.
+	NoCache *bool `toml:"no_cache"`
+	// Note is a comment for humans, such as why the name exists. It is not
+	// served, but is shown in exports and logs.
+	Note string `toml:"note"`
+	// Enabled, if set to false, leaves the entry out of the zone as if it
+	// were not configured, such as during maintenance.
+	Enabled *bool `toml:"enabled"`
+	// Addrs, if not empty, are served as the name's A and AAAA records instead
+	// of its targets. It is only set by sources such as the hosts file.
+	Addrs []netip.Addr `toml:"-"`
+}
+
+// disabled returns whether the entry is left out of its zone.
+func (e ZoneEntry) disabled() bool {
+	return e.Enabled != nil && !*e.Enabled
+}
+
+// MXConfig is a single MX record of a [ZoneEntry].
+type MXConfig struct {
+	Preference int    `toml:"preference"`
+	Exchange   string `toml:"exchange"`
+}
+
+// DSConfig is a single DS record of a [ZoneEntry].
+type DSConfig struct {
+	KeyTag     int `toml:"key_tag"`
+	Algorithm  int `toml:"algorithm"`
+	DigestType int `toml:"digest_type"`
+	// Digest is the digest of the DNSKEY in hex.
+	Digest string `toml:"digest"`
+}
+
+// dsDigestLengths are the lengths of the digests of the known digest types in
+// hex.
+var dsDigestLengths = map[int]int{
+	int(dns.SHA1):   40,
+	int(dns.SHA256): 64,
+	int(dns.GOST94): 64,
+	int(dns.SHA384): 96,
+}
+
+func (c *DSConfig) validate() error {
+	if c.KeyTag < 0 || c.KeyTag > math.MaxUint16 {
+		return fmt.Errorf("invalid key_tag %d", c.KeyTag)
+	}
+	if c.Algorithm < 1 || c.Algorithm > math.MaxUint8 {
+		return fmt.Errorf("invalid algorithm %d", c.Algorithm)
+	}
+	n, ok := dsDigestLengths[c.DigestType]
+	if !ok {
+		return fmt.Errorf("unknown digest_type %d", c.DigestType)
+	}
+	if _, err := hex.DecodeString(c.Digest); err != nil {
+		return fmt.Errorf("digest is not hex: %w", err)
+	}
+	if len(c.Digest) != n {
+		return fmt.Errorf("digest of digest_type %d must be %d hex digits, not %d", c.DigestType, n, len(c.Digest))
+	}
+	c.Digest = strings.ToUpper(c.Digest)
+	return nil
 }
 
-type ZoneConfig map[string]string // name -> target CNAME
+// rr returns the DS record without a header.
+func (c *DSConfig) rr() *dns.DS {
+	return &dns.DS{
+		Hdr:        dns.RR_Header{Rrtype: dns.TypeDS},
+		KeyTag:     uint16(c.KeyTag),
+		Algorithm:  uint8(c.Algorithm),
+		DigestType: uint8(c.DigestType),
+		Digest:     c.Digest,
+	}
+}
+
+// LOCConfig is the location of a LOC record (RFC 1876). Precisions and the
+// size that are 0 use the defaults of the RFC.
+type LOCConfig struct {
+	// Latitude in degrees, where north is positive.
+	Latitude float64 `toml:"latitude"`
+	// Longitude in degrees, where east is positive.
+	Longitude float64 `toml:"longitude"`
+	// Altitude in meters.
+	Altitude float64 `toml:"altitude"`
+	// Size is the diameter of the location in meters. Defaults to 1m.
+	Size float64 `toml:"size"`
+	// HorizontalPrecision in meters. Defaults to 10km.
+	HorizontalPrecision float64 `toml:"horizontal_precision"`
+	// VerticalPrecision in meters. Defaults to 10m.
+	VerticalPrecision float64 `toml:"vertical_precision"`
+}
+
+// rr returns the LOC record of the location without a header.
+func (c *LOCConfig) rr() *dns.LOC {
+	orDefault := func(v, def float64) float64 {
+		if v == 0 {
+			return def
+		}
+		return v
+	}
+	return &dns.LOC{
+		Hdr:       dns.RR_Header{Rrtype: dns.TypeLOC},
+		Latitude:  uint32(int64(dns.LOC_EQUATOR) + int64(math.Round(c.Latitude*dns.LOC_DEGREES))),
+		Longitude: uint32(int64(dns.LOC_PRIMEMERIDIAN) + int64(math.Round(c.Longitude*dns.LOC_DEGREES))),
+		Altitude:  uint32(math.Round(c.Altitude*100) + dns.LOC_ALTITUDEBASE*100),
+		Size:      locPrecision(orDefault(c.Size, 1)),
+		HorizPre:  locPrecision(orDefault(c.HorizontalPrecision, 10000)),
+		VertPre:   locPrecision(orDefault(c.VerticalPrecision, 10)),
+	}
+}
+
+func (c *LOCConfig) validate() error {
+	switch {
+	case c.Latitude < -90 || c.Latitude > 90:
+		return fmt.Errorf("latitude %v is out of range", c.Latitude)
+	case c.Longitude < -180 || c.Longitude > 180:
+		return fmt.Errorf("longitude %v is out of range", c.Longitude)
+	case c.Altitude < -dns.LOC_ALTITUDEBASE || c.Altitude > math.MaxUint32/100-dns.LOC_ALTITUDEBASE:
+		return fmt.Errorf("altitude %v is out of range", c.Altitude)
+	case c.Size < 0 || c.HorizontalPrecision < 0 || c.VerticalPrecision < 0:
+		return fmt.Errorf("size and precisions must not be negative")
+	}
+	return nil
+}
+
+// locPrecision encodes meters in the mantissa and exponent form of LOC
+// records, rounding up to what can be represented.
+func locPrecision(meters float64) uint8 {
+	cm := math.Ceil(meters * 100)
+	var exp uint8
+	for cm > 9 && exp < 9 {
+		cm = math.Ceil(cm / 10)
+		exp++
+	}
+	return uint8(min(cm, 9))<<4 | exp
+}
+
+// TargetConfig is a single target of a [ZoneEntry].
+type TargetConfig struct {
+	Target string `toml:"target"`
+	// Weight is the relative weight of the target when a single CNAME target
+	// has to be chosen. It defaults to 1.
+	Weight int `toml:"weight"`
+	// Check is an optional health check URL for the target. The supported
+	// schemes are tcp://host:port, http:// and https://.
+	Check string `toml:"check"`
+}
+
+type HealthCheckConfig struct {
+	Interval tomlDuration `toml:"interval"`
+	Timeout  tomlDuration `toml:"timeout"`
+}
+
+// CircuitBreakerConfig configures the circuit breaker of forwarded queries.
+type CircuitBreakerConfig struct {
+	// Failures is the number of consecutive failures within Window after
+	// which queries fail immediately for Cooldown. 0 disables the breaker.
+	Failures int          `toml:"failures"`
+	Window   tomlDuration `toml:"window"`
+	Cooldown tomlDuration `toml:"cooldown"`
+}
+
+// BackendConfig configures dynamic sources of zones in addition to the config
+// file.
+type BackendConfig struct {
+	Consul *ConsulConfig `toml:"consul"`
+	SQLite *SQLiteConfig `toml:"sqlite"`
+}
+
+// DebugConfig contains options that are only useful for testing.
+type DebugConfig struct {
+	ResponseDelay  tomlDuration `toml:"response_delay"`
+	ResponseJitter tomlDuration `toml:"response_jitter"`
+	// RefusalReasons answers TXT queries for "_why.<name>" with why the name
+	// was last refused or blocked for the client, see [refusalHandler].
+	RefusalReasons bool `toml:"refusal_reasons"`
+	// ShadowCompare is the fraction of authoritative answers that are
+	// compared against fallback_dns, see [shadowHandler].
+	ShadowCompare float64 `toml:"shadow_compare"`
+}
+
+// TLSConfig configures the certificate for encrypted transports. Both files
+// may also be secret references, see [resolveSecret].
+type TLSConfig struct {
+	CertFile string `toml:"cert_file"`
+	KeyFile  string `toml:"key_file"`
+}
+
+// Load loads the configured certificate into a [tls.Config].
+func (c TLSConfig) Load(ctx context.Context) (*tls.Config, error) {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, fmt.Errorf("tls.cert_file and tls.key_file must be set")
+	}
+
+	certPEM, err := resolveSecret(ctx, c.CertFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	keyPEM, err := resolveSecret(ctx, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS key: %w", err)
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS13,
+	}, nil
+}
 
 type TailscaleConfig struct {
 	Enable    bool   `toml:"enable"`
 	Ephemeral bool   `toml:"ephemeral"`
 	Hostname  string `toml:"hostname"`
+	SelfName  string `toml:"self_name"`
+	// AuthKey is the auth key or a secret reference to it. It defaults to
+	// $TS_AUTHKEY.
+	AuthKey string `toml:"auth_key"`
+	// ControlURL is the coordination server, such as a Headscale instance. It
+	// defaults to Tailscale's.
+	ControlURL string `toml:"control_url"`
+	// APIURL is the Tailscale API used to create auth keys from OAuth client
+	// secrets.
+	APIURL string   `toml:"api_url"`
+	Tags   []string `toml:"tags"`
+	// ShutdownGrace is how long in-flight queries may take to complete on
+	// shutdown before the Tailscale listeners are closed.
+	ShutdownGrace tomlDuration `toml:"shutdown_grace"`
+}
+
+type tomlRegexp struct{ *regexp.Regexp }
+
+func (r *tomlRegexp) UnmarshalText(text []byte) error {
+	// Anchor the expression so that it has to match the whole name.
+	re, err := regexp.Compile(`^(?:` + string(text) + `)$`)
+	if err != nil {
+		return err
+	}
+	r.Regexp = re
+	return nil
 }
 
 type tomlDuration time.Duration
@@ -37,20 +538,68 @@ func (d *tomlDuration) UnmarshalText(text []byte) error {
 	return nil
 }
 
+// tailscaleDNS is the DNS resolver of Tailscale, which is only reachable from
+// hosts that are on a Tailnet.
+const tailscaleDNS = "100.100.100.100:53"
+
 func defaultConfig() *Config {
 	return &Config{
-		Addr:        ":53",
-		Expire:      tomlDuration(5 * time.Second),
-		Finalize:    true,
-		FallbackDNS: "100.100.100.100:53",
+		Addr:           ":53",
+		Expire:         tomlDuration(5 * time.Second),
+		Finalize:       true,
+		FinalizeFamily: familyBoth,
+		NegativeTTL:    tomlDuration(5 * time.Minute),
+		FinalizeConns:  8,
+		MaxCNAMEDepth:  8,
+		// Most stub resolvers retry or give up after 2 seconds.
+		LookupTimeout:  tomlDuration(2 * time.Second),
+		ShuffleAnswers: true,
+		Truncation:     truncationEmpty,
+		// The default of github.com/miekg/dns.
+		TCPIdleTimeout: tomlDuration(8 * time.Second),
+		// RFC 8467 recommends padding responses to 468 bytes.
+		PaddingBlockSize: 468,
+		MalformedQueries: malformedIgnore,
+		RootQueries:      rootProxy,
+		HTTPAllow: []netip.Prefix{
+			netip.MustParsePrefix("127.0.0.0/8"),
+			netip.MustParsePrefix("::1/128"),
+		},
+		FallbackBreaker: CircuitBreakerConfig{
+			Window:   tomlDuration(10 * time.Second),
+			Cooldown: tomlDuration(30 * time.Second),
+		},
+		FallbackPool: FallbackPoolConfig{
+			ProbeInterval: tomlDuration(10 * time.Second),
+			ProbeTimeout:  tomlDuration(2 * time.Second),
+		},
+		HealthCheck: HealthCheckConfig{
+			Interval: tomlDuration(10 * time.Second),
+			Timeout:  tomlDuration(2 * time.Second),
+		},
+		Admin: AdminConfig{
+			Allow: []netip.Prefix{
+				netip.MustParsePrefix("127.0.0.0/8"),
+				netip.MustParsePrefix("::1/128"),
+			},
+		},
+		StatsTXT: StatsTXTConfig{
+			Allow: []netip.Prefix{
+				netip.MustParsePrefix("127.0.0.0/8"),
+				netip.MustParsePrefix("::1/128"),
+			},
+		},
 		Tailscale: TailscaleConfig{
-			Enable:   false,
-			Hostname: "cname-serve",
+			Enable:        false,
+			Hostname:      "cname-serve",
+			ShutdownGrace: tomlDuration(2 * time.Second),
 		},
 	}
 }
 
-func ParseConfigFile(path string) (*Config, error) {
+// ParseConfigFile parses the config file at path. If strict is true, then
+// unknown keys are reported as errors.
+func ParseConfigFile(path string, strict bool) (*Config, error) {
 	slog.Debug(
 		"parsing config file",
 		"path", path)
@@ -60,10 +609,501 @@ func ParseConfigFile(path string) (*Config, error) {
 		return nil, fmt.Errorf("failed to read config file: %w", err)
 	}
 
-	cfg := defaultConfig()
-	if err := toml.Unmarshal(d, cfg); err != nil {
+	var rawDoc map[string]any
+	if err := toml.Unmarshal(d, &rawDoc); err != nil {
 		return nil, fmt.Errorf("failed to parse config file: %w", err)
 	}
+	warnDeprecatedKeys(rawDoc, nil)
+
+	// Zone entries can be either strings or tables, which go-toml cannot
+	// decode into a single type, so we decode them separately.
+	cfg := defaultConfig()
+	doc := struct {
+		*Config
+		Zones map[string]map[string]any `toml:"zones"`
+		// This shadows Config.SuppressTypes with the names of the record
+		// types, which are checked below.
+		SuppressTypes map[netip.Prefix][]string `toml:"suppress_types"`
+	}{
+		Config: cfg,
+	}
+
+	dec := toml.NewDecoder(bytes.NewReader(d))
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", unknownKeysError(err, reflect.TypeFor[Config](), true))
+	}
+
+	if _, ok := rawDoc["fallback_dns"]; !ok {
+		// An empty fallback_dns disables forwarding, so only an unset one
+		// gets the default. Options that query a single upstream use the
+		// first server of the pool.
+		if len(cfg.FallbackPool.Servers) > 0 {
+			cfg.FallbackDNS = cfg.FallbackPool.Servers[0]
+		} else {
+			cfg.FallbackDNS = defaultFallbackDNS(cfg)
+		}
+	}
+	if len(cfg.FallbackPool.Servers) > 0 {
+		if cfg.FallbackDNS == "" {
+			return nil, fmt.Errorf("fallback_pool.servers cannot be used with an empty fallback_dns")
+		}
+		if slices.Contains(cfg.FallbackPool.Servers, "") {
+			return nil, fmt.Errorf("fallback_pool.servers must not be empty")
+		}
+		if cfg.FallbackPool.ProbeInterval <= 0 || cfg.FallbackPool.ProbeTimeout <= 0 {
+			return nil, fmt.Errorf("fallback_pool.probe_interval and fallback_pool.probe_timeout must be positive")
+		}
+	}
+
+	if cfg.AnswerOrder == "" {
+		// The deprecated shuffle options only apply if answer_order is unset.
+		switch {
+		case !cfg.ShuffleAnswers:
+			cfg.AnswerOrder = answerOrderFixed
+		case cfg.ShufflePerClient:
+			cfg.AnswerOrder = answerOrderClientAffinity
+		default:
+			cfg.AnswerOrder = answerOrderRandom
+		}
+	}
+	switch cfg.AnswerOrder {
+	case answerOrderFixed, answerOrderRandom, answerOrderRoundRobin, answerOrderClientAffinity:
+	default:
+		return nil, fmt.Errorf("invalid answer_order %q, must be %q, %q, %q or %q", cfg.AnswerOrder,
+			answerOrderFixed, answerOrderRandom, answerOrderRoundRobin, answerOrderClientAffinity)
+	}
+
+	switch cfg.Truncation {
+	case truncationEmpty, truncationPartial:
+	default:
+		return nil, fmt.Errorf("invalid truncation %q, must be %q or %q", cfg.Truncation, truncationEmpty, truncationPartial)
+	}
+
+	switch cfg.MalformedQueries {
+	case malformedIgnore, malformedFormErr:
+	default:
+		return nil, fmt.Errorf("invalid malformed_queries %q, must be %q or %q", cfg.MalformedQueries, malformedIgnore, malformedFormErr)
+	}
+
+	switch cfg.RootQueries {
+	case rootProxy, rootRefuse, rootHints:
+	default:
+		return nil, fmt.Errorf("invalid root_queries %q, must be %q, %q or %q", cfg.RootQueries, rootProxy, rootRefuse, rootHints)
+	}
+
+	switch cfg.FinalizeFamily {
+	case familyBoth, familyIPv4, familyIPv6:
+	default:
+		return nil, fmt.Errorf("invalid finalize_family %q, must be %q, %q or %q", cfg.FinalizeFamily, familyBoth, familyIPv4, familyIPv6)
+	}
+
+	switch cfg.Serial {
+	case serialFixed, serialUnixTime, serialDateCounter, serialIncrement:
+	default:
+		return nil, fmt.Errorf("invalid serial %q, must be %q, %q, %q or %q", cfg.Serial, serialFixed, serialUnixTime, serialDateCounter, serialIncrement)
+	}
+
+	if err := cfg.Allowlist.load(); err != nil {
+		return nil, err
+	}
+
+	if cfg.CacheMaxEntries < 0 {
+		return nil, fmt.Errorf("invalid cache_max_entries %d", cfg.CacheMaxEntries)
+	}
+	if cfg.MaxZones < 0 {
+		return nil, fmt.Errorf("invalid max_zones %d", cfg.MaxZones)
+	}
+	if cfg.MaxNames < 0 {
+		return nil, fmt.Errorf("invalid max_names %d", cfg.MaxNames)
+	}
+	if cfg.DSCP < 0 || cfg.DSCP > 63 {
+		return nil, fmt.Errorf("invalid dscp %d, must be between 0 and 63", cfg.DSCP)
+	}
+	if cfg.PaddingBlockSize < 0 {
+		return nil, fmt.Errorf("invalid padding_block_size %d", cfg.PaddingBlockSize)
+	}
+	if cfg.BindRetries < 0 {
+		return nil, fmt.Errorf("invalid bind_retries %d", cfg.BindRetries)
+	}
+	if cfg.TCPIdleTimeout <= 0 || time.Duration(cfg.TCPIdleTimeout) > maxTCPIdleTimeout {
+		return nil, fmt.Errorf("invalid tcp_idle_timeout %v, must be positive and at most %v",
+			time.Duration(cfg.TCPIdleTimeout), maxTCPIdleTimeout)
+	}
+	if cfg.MaxCNAMEDepth < 0 {
+		return nil, fmt.Errorf("invalid max_cname_depth %d", cfg.MaxCNAMEDepth)
+	}
+	if cfg.Admin.Addr != "" && cfg.Admin.Token == "" {
+		return nil, fmt.Errorf("admin.token is required to use admin.addr")
+	}
+
+	if cfg.FinalizeFallback {
+		if cfg.FinalizeResolver != "" {
+			return nil, fmt.Errorf("finalize_via_fallback cannot be used with finalize_resolver")
+		}
+		if cfg.FallbackDNS == "" {
+			return nil, fmt.Errorf("finalize_via_fallback requires fallback_dns")
+		}
+	}
+	if cfg.IncludeExternalA && cfg.FallbackDNS == "" {
+		return nil, fmt.Errorf("include_external_target_a requires fallback_dns")
+	}
+	if cfg.MaxMessageSize != 0 && (cfg.MaxMessageSize < 12 || cfg.MaxMessageSize > dns.MaxMsgSize) {
+		// Every message has a 12 byte header.
+		return nil, fmt.Errorf("invalid max_message_size %d, must be between 12 and %d", cfg.MaxMessageSize, dns.MaxMsgSize)
+	}
+	if cfg.TTLJitter < 0 || cfg.TTLJitter >= 1 {
+		return nil, fmt.Errorf("invalid ttl_jitter %v, must be at least 0 and less than 1", cfg.TTLJitter)
+	}
+
+	if cfg.Debug.ShadowCompare < 0 || cfg.Debug.ShadowCompare > 1 {
+		return nil, fmt.Errorf("invalid debug.shadow_compare %v, must be between 0 and 1", cfg.Debug.ShadowCompare)
+	}
+	if cfg.Debug.ShadowCompare > 0 && cfg.FallbackDNS == "" {
+		return nil, fmt.Errorf("debug.shadow_compare requires fallback_dns")
+	}
+
+	for i, qtype := range cfg.FinalizeQtypes {
+		qtype = strings.ToUpper(qtype)
+		if _, ok := dns.StringToType[qtype]; !ok {
+			return nil, fmt.Errorf("invalid qtype %q in finalize_qtypes", qtype)
+		}
+		cfg.FinalizeQtypes[i] = qtype
+	}
+
+	minTTL := make(typeTTLs, len(cfg.MinTTL))
+	for rawType, ttl := range cfg.MinTTL {
+		rrtype := strings.ToUpper(rawType)
+		if _, ok := dns.StringToType[rrtype]; !ok {
+			return nil, fmt.Errorf("invalid type %q in min_ttl", rawType)
+		}
+		if ttl < 0 {
+			return nil, fmt.Errorf("invalid min_ttl of %s", rrtype)
+		}
+		minTTL[rrtype] = ttl
+	}
+	cfg.MinTTL = minTTL
+
+	cfg.SuppressTypes = make(clientTypes, len(doc.SuppressTypes))
+	for prefix, rawTypes := range doc.SuppressTypes {
+		prefix = prefix.Masked()
+		for _, rawType := range rawTypes {
+			rrtype, ok := dns.StringToType[strings.ToUpper(rawType)]
+			if !ok {
+				return nil, fmt.Errorf("invalid type %q in suppress_types of %s", rawType, prefix)
+			}
+			cfg.SuppressTypes[prefix] = append(cfg.SuppressTypes[prefix], rrtype)
+		}
+	}
+
+	if err := parseSOANames(&cfg.SOAMName, &cfg.SOARName); err != nil {
+		return nil, err
+	}
+
+	zoneOptions := make(map[string]ZoneOptions, len(cfg.ZoneOptions))
+	for _, rawZone := range slices.Sorted(maps.Keys(cfg.ZoneOptions)) {
+		opts := cfg.ZoneOptions[rawZone]
+		for i, rule := range opts.Rewrite {
+			if rule.Match.Regexp == nil || rule.Replace == "" {
+				return nil, fmt.Errorf("rewrite rule %d of zone %q must have both match and replace", i, rawZone)
+			}
+		}
+
+		if opts.TargetSuffix != "" {
+			opts.TargetSuffix = newdns.NormalizeDomain(opts.TargetSuffix, true, true, false)
+			if _, ok := dns.IsDomainName(opts.TargetSuffix); !ok {
+				return nil, fmt.Errorf("invalid target_suffix %q of zone %q", opts.TargetSuffix, rawZone)
+			}
+		}
+
+		if err := parseSOANames(&opts.SOAMName, &opts.SOARName); err != nil {
+			return nil, fmt.Errorf("zone_options of zone %q: %w", rawZone, err)
+		}
+
+		if opts.Defaults.TTL != nil && *opts.Defaults.TTL < 0 {
+			return nil, fmt.Errorf("invalid defaults.ttl of zone %q", rawZone)
+		}
+		switch opts.Defaults.As {
+		case "", entryAsCNAME, entryAsA, entryAsAlias:
+		default:
+			return nil, fmt.Errorf("invalid defaults.as %q of zone %q, must be %q, %q or %q",
+				opts.Defaults.As, rawZone, entryAsCNAME, entryAsA, entryAsAlias)
+		}
+
+		zone := newdns.NormalizeDomain(rawZone, true, true, false)
+		if _, ok := zoneOptions[zone]; ok {
+			return nil, fmt.Errorf("zone_options of zone %q are defined twice", zone)
+		}
+		zoneOptions[zone] = opts
+	}
+	cfg.ZoneOptions = zoneOptions
+
+	switch {
+	case cfg.Version < 0:
+		return nil, fmt.Errorf("invalid config version %d", cfg.Version)
+	case cfg.Version > configVersion:
+		slog.Warn(
+			"config file is for a newer version of cname-serve, some options may be ignored",
+			"path", path,
+			"version", cfg.Version,
+			"supported_version", configVersion)
+	}
+
+	// Check the limits before parsing the zones, which is what takes memory.
+	var names int
+	for _, rawEntries := range doc.Zones {
+		names += len(rawEntries)
+	}
+	if err := cfg.checkZoneLimits(len(doc.Zones), names); err != nil {
+		return nil, err
+	}
+
+	// Zones are keyed by their normalized names, so that e.g. "example.com" and
+	// "Example.com." cannot define the same zone twice.
+	cfg.Zones = make(map[string]ZoneConfig, len(doc.Zones))
+	zoneKeys := make(map[string]string, len(doc.Zones))
+	for _, rawZone := range slices.Sorted(maps.Keys(doc.Zones)) {
+		rawEntries := doc.Zones[rawZone]
+		zone := newdns.NormalizeDomain(rawZone, true, true, false)
+		if other, ok := zoneKeys[zone]; ok {
+			return nil, fmt.Errorf("zone %q is defined twice as %q and %q", zone, other, rawZone)
+		}
+		zoneKeys[zone] = rawZone
+
+		zcfg := make(ZoneConfig, len(rawEntries))
+		for _, rawName := range slices.Sorted(maps.Keys(rawEntries)) {
+			entry, err := parseZoneEntry(rawEntries[rawName], cfg.Vars, strict)
+			if err != nil {
+				return nil, fmt.Errorf("invalid entry %q in zone %q: %w", rawName, zone, err)
+			}
+
+			// The zone apex can be written as "@" like in zone files.
+			name := rawName
+			if name == "@" {
+				name = ""
+				if _, ok := rawEntries[""]; ok {
+					return nil, fmt.Errorf("zone %q defines its apex twice as \"\" and \"@\"", zone)
+				}
+			}
+			if name == "" && entry.As == entryAsCNAME {
+				return nil, fmt.Errorf("the apex of zone %q cannot be served as a CNAME", zone)
+			}
+			if name == "" && len(entry.DS) > 0 {
+				// DS records of a zone belong in its parent zone.
+				return nil, fmt.Errorf("the apex of zone %q cannot have ds records", zone)
+			}
+
+			zcfg[name] = entry
+		}
+		cfg.Zones[zone] = zcfg
+	}
 
 	return cfg, nil
 }
+
+// checkZoneLimits returns an error if the number of zones or names exceeds
+// max_zones or max_names.
+func (c *Config) checkZoneLimits(zones, names int) error {
+	if c.MaxZones > 0 && zones > c.MaxZones {
+		return fmt.Errorf("%d zones are configured, which is more than max_zones of %d", zones, c.MaxZones)
+	}
+	if c.MaxNames > 0 && names > c.MaxNames {
+		return fmt.Errorf("%d names are configured, which is more than max_names of %d", names, c.MaxNames)
+	}
+	return nil
+}
+
+func parseZoneEntry(v any, vars map[string]string, strict bool) (ZoneEntry, error) {
+	var entry ZoneEntry
+
+	switch v := v.(type) {
+	case string:
+		entry.Target = v
+	case map[string]any:
+		b, err := toml.Marshal(v)
+		if err != nil {
+			return entry, err
+		}
+		dec := toml.NewDecoder(bytes.NewReader(b))
+		if strict {
+			dec.DisallowUnknownFields()
+		}
+		if err := dec.Decode(&entry); err != nil {
+			return entry, unknownKeysError(err, reflect.TypeFor[ZoneEntry](), false)
+		}
+	default:
+		return entry, fmt.Errorf("expected string or table, got %T", v)
+	}
+
+	if entry.Target != "" {
+		entry.Targets = append([]TargetConfig{{Target: entry.Target}}, entry.Targets...)
+		entry.Target = ""
+	}
+
+	if entry.TTL != nil && *entry.TTL < 0 {
+		return entry, fmt.Errorf("invalid ttl %v", time.Duration(*entry.TTL))
+	}
+
+	if len(entry.Schedule) > 0 && len(entry.Targets) == 0 {
+		return entry, fmt.Errorf("schedule requires targets")
+	}
+
+	if (len(entry.TXT) > 0 || len(entry.MX) > 0) && (entry.DNAME != "" || entry.LOC != nil || entry.Rcode != "" || len(entry.DS) > 0) {
+		return entry, fmt.Errorf("txt and mx cannot be used with rcode, loc, dname or ds")
+	}
+
+	if len(entry.DS) > 0 {
+		if entry.DNAME != "" || entry.LOC != nil || entry.Rcode != "" || len(entry.Targets) > 0 {
+			return entry, fmt.Errorf("ds cannot be used with targets, rcode, loc or dname")
+		}
+		for i := range entry.DS {
+			if err := entry.DS[i].validate(); err != nil {
+				return entry, fmt.Errorf("ds %d: %w", i, err)
+			}
+		}
+		return entry, nil
+	}
+
+	if entry.DNAME != "" {
+		if entry.LOC != nil || entry.Rcode != "" || len(entry.Targets) > 0 {
+			return entry, fmt.Errorf("dname cannot be used with targets, rcode or loc")
+		}
+		if !newdns.IsDomain(entry.DNAME, false) {
+			return entry, fmt.Errorf("invalid dname %q", entry.DNAME)
+		}
+		entry.DNAME = newdns.NormalizeDomain(entry.DNAME, true, true, false)
+		return entry, nil
+	}
+
+	if entry.LOC != nil {
+		if entry.Rcode != "" || len(entry.Targets) > 0 {
+			return entry, fmt.Errorf("loc cannot be used with targets or rcode")
+		}
+		if err := entry.LOC.validate(); err != nil {
+			return entry, fmt.Errorf("invalid loc: %w", err)
+		}
+		return entry, nil
+	}
+
+	if entry.Rcode != "" {
+		entry.Rcode = strings.ToUpper(entry.Rcode)
+		if rcode, ok := dns.StringToRcode[entry.Rcode]; !ok || rcode == dns.RcodeSuccess {
+			return entry, fmt.Errorf("invalid rcode %q", entry.Rcode)
+		}
+		if len(entry.Targets) > 0 {
+			return entry, fmt.Errorf("rcode cannot be used with targets")
+		}
+		return entry, nil
+	}
+
+	if len(entry.Targets) == 0 && len(entry.TXT) == 0 && len(entry.MX) == 0 {
+		return entry, fmt.Errorf("no targets")
+	}
+
+	for i, mx := range entry.MX {
+		if mx.Preference < 0 || mx.Preference > math.MaxUint16 {
+			return entry, fmt.Errorf("mx %d has invalid preference %d", i, mx.Preference)
+		}
+		if !newdns.IsDomain(mx.Exchange, false) {
+			return entry, fmt.Errorf("mx %d has invalid exchange %q", i, mx.Exchange)
+		}
+		entry.MX[i].Exchange = newdns.NormalizeDomain(mx.Exchange, true, true, false)
+	}
+
+	switch entry.As {
+	case "", entryAsCNAME, entryAsA, entryAsAlias:
+	default:
+		return entry, fmt.Errorf("invalid as %q, must be %q, %q or %q", entry.As, entryAsCNAME, entryAsA, entryAsAlias)
+	}
+
+	for i, target := range entry.Targets {
+		var err error
+		if target.Target, err = expandVars(target.Target, vars); err != nil {
+			return entry, err
+		}
+		if target.Check, err = expandVars(target.Check, vars); err != nil {
+			return entry, err
+		}
+		entry.Targets[i] = target
+
+		if target.Target == "" {
+			return entry, fmt.Errorf("target %d is empty", i)
+		}
+		switch {
+		case target.Weight < 0:
+			return entry, fmt.Errorf("target %q has negative weight", target.Target)
+		case target.Weight == 0:
+			entry.Targets[i].Weight = 1
+		}
+	}
+
+	for i, scfg := range entry.Schedule {
+		var err error
+		if scfg.Target, err = expandVars(scfg.Target, vars); err != nil {
+			return entry, err
+		}
+		entry.Schedule[i] = scfg
+
+		if _, err := scfg.parse(); err != nil {
+			return entry, fmt.Errorf("schedule %d: %w", i, err)
+		}
+	}
+
+	return entry, nil
+}
+
+// parseSOANames validates and normalizes the MNAME and RNAME of SOA records.
+// The MNAME becomes an FQDN, and the RNAME becomes an email address if it is
+// given in the DNS form such as "john\.doe.example.com.".
+func parseSOANames(mname, rname *string) error {
+	if *mname != "" {
+		if !newdns.IsDomain(*mname, false) {
+			return fmt.Errorf("invalid soa_mname %q", *mname)
+		}
+		*mname = newdns.NormalizeDomain(*mname, true, true, false)
+	}
+
+	if *rname != "" {
+		email := *rname
+		if !strings.Contains(email, "@") {
+			// The first unescaped dot separates the local part.
+			name := strings.TrimSuffix(email, ".")
+			for i := 0; i < len(name); i++ {
+				if name[i] == '\\' {
+					i++
+					continue
+				}
+				if name[i] == '.' {
+					email = strings.ReplaceAll(name[:i], "\\.", ".") + "@" + name[i+1:]
+					break
+				}
+			}
+		}
+
+		local, domain, ok := strings.Cut(email, "@")
+		if !ok || local == "" || !newdns.IsDomain(domain, false) {
+			return fmt.Errorf("invalid soa_rname %q, must be an email address such as admin@example.com", *rname)
+		}
+		*rname = email
+	}
+
+	return nil
+}
+
+var varRefRe = regexp.MustCompile(`\$\{([^}]*)\}`)
+
+// expandVars replaces all ${name} references in s with the values in vars.
+func expandVars(s string, vars map[string]string) (string, error) {
+	var err error
+	s = varRefRe.ReplaceAllStringFunc(s, func(ref string) string {
+		name := varRefRe.FindStringSubmatch(ref)[1]
+		v, ok := vars[name]
+		if !ok && err == nil {
+			err = fmt.Errorf("undefined variable %q", name)
+		}
+		return v
+	})
+	return s, err
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseConfigFileInvalid(t *testing.T) {
+	tests := []struct {
+		config string
+		err    string
+	}{
+		{`padding_block_size = -1`, "invalid padding_block_size -1"},
+		{`serial = "weekly"`, `invalid serial "weekly", must be "", "unixtime", "date-counter" or "increment"`},
+		{`suppress_types = { "10.20.0.0" = ["AAAA"] }`, `netip.ParsePrefix("10.20.0.0")`},
+		{`suppress_types = { "10.20.0.1/16" = ["AAA"] }`, `invalid type "AAA" in suppress_types of 10.20.0.0/16`},
+	}
+
+	for _, test := range tests {
+		_, err := ParseConfigFile(writeTestConfig(t, test.config), true)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %v, want %q", test.config, err, test.err)
+		}
+	}
+}
+
+func TestSuppressedTypes(t *testing.T) {
+	cfg := testConfig(t, `
+suppress_types = { "10.20.0.1/16" = ["aaaa"], "10.0.0.0/8" = ["MX"] }
+`)
+
+	tests := []struct {
+		client string
+		types  []uint16
+	}{
+		{"10.20.1.2", []uint16{dns.TypeMX, dns.TypeAAAA}},
+		{"10.1.2.3", []uint16{dns.TypeMX}},
+		{"192.0.2.1", nil},
+	}
+
+	for _, test := range tests {
+		types := cfg.suppressedTypes(netip.MustParseAddr(test.client))
+		slices.Sort(types)
+		if !slices.Equal(types, test.types) {
+			t.Errorf("%s: got types %v, want %v", test.client, types, test.types)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+// deprecatedKeys maps dotted config keys that are deprecated or have been
+// removed to a hint on what to do instead.
+var deprecatedKeys = map[string]string{
+	"shuffle_answers":    `use answer_order = "random", or "fixed" instead of false`,
+	"shuffle_per_client": `use answer_order = "client-affinity"`,
+}
+
+// warnDeprecatedKeys logs a warning for every deprecated key in doc.
+func warnDeprecatedKeys(doc map[string]any, path []string) {
+	for k, v := range doc {
+		key := append(path[:len(path):len(path)], k)
+		if hint, ok := deprecatedKeys[strings.Join(key, ".")]; ok {
+			slog.Warn(
+				"config file uses a deprecated key",
+				"key", strings.Join(key, "."),
+				"hint", hint)
+		}
+		if table, ok := v.(map[string]any); ok {
+			warnDeprecatedKeys(table, key)
+		}
+	}
+}
+
+// unknownKeysError turns a strict mode error from decoding into typ into an
+// error that lists the unknown keys along with suggestions for each of them.
+// Other errors are returned as-is. If withLines is true, then the line of each
+// key is included.
+func unknownKeysError(err error, typ reflect.Type, withLines bool) error {
+	var strictErr *toml.StrictMissingError
+	if !errors.As(err, &strictErr) {
+		return err
+	}
+
+	var msgs []string
+	for _, e := range strictErr.Errors {
+		key := e.Key()
+
+		msg := fmt.Sprintf("unknown key %q", strings.Join(key, "."))
+		if withLines {
+			row, _ := e.Position()
+			msg += fmt.Sprintf(" on line %d", row)
+		}
+		if hint, ok := deprecatedKeys[strings.Join(key, ".")]; ok {
+			msg += fmt.Sprintf(" (deprecated: %s)", hint)
+		} else if suggestion := suggestKey(typ, key); suggestion != "" {
+			msg += fmt.Sprintf(" (did you mean %q?)", suggestion)
+		}
+		msgs = append(msgs, msg)
+	}
+
+	return errors.New(strings.Join(msgs, "; "))
+}
+
+// suggestKey returns the known key closest to the last element of key, or an
+// empty string if none is close enough.
+func suggestKey(typ reflect.Type, key []string) string {
+	known := knownKeys(typ, key[:len(key)-1])
+	unknown := key[len(key)-1]
+
+	var best string
+	bestDist := len(unknown)/2 + 1
+	for _, k := range known {
+		if d := levenshtein(unknown, k); d < bestDist {
+			best, bestDist = k, d
+		}
+	}
+	return best
+}
+
+// knownKeys returns the keys of the table at the given path within typ.
+func knownKeys(typ reflect.Type, path []string) []string {
+	for {
+		switch typ.Kind() {
+		case reflect.Pointer, reflect.Slice, reflect.Array:
+			typ = typ.Elem()
+			continue
+		case reflect.Map:
+			if len(path) == 0 {
+				return nil
+			}
+			typ, path = typ.Elem(), path[1:]
+			continue
+		}
+		break
+	}
+
+	if typ.Kind() != reflect.Struct {
+		return nil
+	}
+
+	var keys []string
+	for i := range typ.NumField() {
+		field := typ.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("toml"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		if len(path) > 0 && name == path[0] {
+			return knownKeys(field.Type, path[1:])
+		}
+		keys = append(keys, name)
+	}
+
+	if len(path) > 0 {
+		return nil
+	}
+	return keys
+}
+
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	consulWaitTime   = 5 * time.Minute
+	consulRetryDelay = 5 * time.Second
+)
+
+// ConsulConfig configures a Consul KV prefix to serve zones from. Each key
+// below the prefix has the form <zone>/<name> and its value is the target.
+type ConsulConfig struct {
+	Addr   string `toml:"addr"`
+	Prefix string `toml:"prefix"`
+	// Token is the ACL token. It defaults to $CONSUL_HTTP_TOKEN.
+	Token string `toml:"token"`
+}
+
+type consulKV struct {
+	Key   string
+	Value []byte
+}
+
+// watchConsul watches the configured Consul KV prefix and updates the store's
+// dynamic zones whenever it changes. It only returns once the context is
+// canceled.
+func watchConsul(ctx context.Context, cfg ConsulConfig, store *zoneStore) error {
+	if cfg.Addr == "" {
+		cfg.Addr = "http://127.0.0.1:8500"
+	}
+	if cfg.Token == "" {
+		cfg.Token = os.Getenv("CONSUL_HTTP_TOKEN")
+	}
+	prefix := strings.Trim(cfg.Prefix, "/") + "/"
+
+	slog := slog.With(
+		"component", "consul",
+		"addr", cfg.Addr,
+		"prefix", prefix)
+
+	slog.Info("watching Consul for zones")
+
+	var index uint64
+	for ctx.Err() == nil {
+		kvs, newIndex, err := consulGetPrefix(ctx, cfg, prefix, index)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+
+			slog.Warn(
+				"failed to query Consul, retrying",
+				"err", err)
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(consulRetryDelay):
+			}
+			continue
+		}
+
+		// Consul asks clients to reset the index if it ever goes backwards,
+		// and to use at least 1, since queries with an index of 0 don't block.
+		changed := newIndex != index || newIndex == 0
+		if newIndex < index {
+			newIndex = 0
+		}
+		index = max(newIndex, 1)
+		if !changed {
+			continue
+		}
+
+		zones, err := consulKVsToZones(kvs, prefix)
+		if err != nil {
+			slog.Error(
+				"invalid zones in Consul, keeping the old zones",
+				"err", err)
+			continue
+		}
+
+		if err := store.SetDynamicZones("consul", zones); err != nil {
+			slog.Error(
+				"failed to apply zones from Consul, keeping the old zones",
+				"err", err)
+			continue
+		}
+
+		slog.Info(
+			"updated zones from Consul",
+			"keys", len(kvs))
+	}
+
+	return nil
+}
+
+// consulGetPrefix does a blocking query for all keys below the prefix.
+func consulGetPrefix(ctx context.Context, cfg ConsulConfig, prefix string, index uint64) ([]consulKV, uint64, error) {
+	query := url.Values{
+		"recurse": {""},
+		"index":   {strconv.FormatUint(index, 10)},
+		"wait":    {consulWaitTime.String()},
+	}
+
+	u := strings.TrimSuffix(cfg.Addr, "/") + "/v1/kv/" + prefix + "?" + query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if cfg.Token != "" {
+		req.Header.Set("X-Consul-Token", cfg.Token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNotFound:
+	default:
+		return nil, 0, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	// Without the index, the next query couldn't block until a change.
+	newIndex, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid X-Consul-Index %q", resp.Header.Get("X-Consul-Index"))
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		// No keys below the prefix.
+		return nil, newIndex, nil
+	}
+
+	var kvs []consulKV
+	if err := json.NewDecoder(resp.Body).Decode(&kvs); err != nil {
+		return nil, 0, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return kvs, newIndex, nil
+}
+
+func consulKVsToZones(kvs []consulKV, prefix string) (map[string]ZoneConfig, error) {
+	zones := make(map[string]ZoneConfig)
+	for _, kv := range kvs {
+		key := strings.TrimPrefix(kv.Key, prefix)
+		if key == "" || strings.HasSuffix(key, "/") {
+			// Folders have no value.
+			continue
+		}
+
+		zone, name, ok := strings.Cut(key, "/")
+		if !ok {
+			return nil, fmt.Errorf("key %q is not of the form <zone>/<name>", kv.Key)
+		}
+
+		entry, err := parseZoneEntry(strings.TrimSpace(string(kv.Value)), nil, false)
+		if err != nil {
+			return nil, fmt.Errorf("invalid entry at key %q: %w", kv.Key, err)
+		}
+
+		if zones[zone] == nil {
+			zones[zone] = make(ZoneConfig)
+		}
+		zones[zone][name] = entry
+	}
+	return zones, nil
+}
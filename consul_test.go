@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestConsulGetPrefix(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		index  string
+		body   string
+		keys   int
+		want   uint64
+		err    bool
+	}{
+		{"keys", http.StatusOK, "42", `[{"Key":"zones/a.test/www","Value":"d3d3LmV4YW1wbGUubmV0"}]`, 1, 42, false},
+		{"no keys", http.StatusNotFound, "7", ``, 0, 7, false},
+		{"missing index", http.StatusOK, "", `[]`, 0, 0, true},
+		{"invalid index", http.StatusOK, "x", `[]`, 0, 0, true},
+		{"error", http.StatusInternalServerError, "42", ``, 0, 0, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if test.index != "" {
+					w.Header().Set("X-Consul-Index", test.index)
+				}
+				w.WriteHeader(test.status)
+				w.Write([]byte(test.body))
+			}))
+			defer srv.Close()
+
+			kvs, index, err := consulGetPrefix(context.Background(), ConsulConfig{Addr: srv.URL}, "zones/", 0)
+			if (err != nil) != test.err {
+				t.Fatalf("got error %v, want error %v", err, test.err)
+			}
+			if len(kvs) != test.keys || index != test.want {
+				t.Errorf("got %d keys at index %d, want %d at %d", len(kvs), index, test.keys, test.want)
+			}
+		})
+	}
+}
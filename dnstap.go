@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// dnstapContentType is the Frame Streams content type of dnstap.
+	dnstapContentType = "protobuf:dnstap.Dnstap"
+	// dnstapQueueSize is how many messages are queued for the socket before
+	// new ones are dropped.
+	dnstapQueueSize = 4096
+	// dnstapRetryDelay is how long to wait before reconnecting to the socket.
+	dnstapRetryDelay = 5 * time.Second
+	// dnstapTimeout is the longest that a write to the socket may take.
+	dnstapTimeout = 5 * time.Second
+	// dnstapMaxControlFrameLen is the longest control frame that is read.
+	dnstapMaxControlFrameLen = 512
+)
+
+// Frame Streams control frame types and fields.
+const (
+	fstrmControlAccept      = 0x01
+	fstrmControlStart       = 0x02
+	fstrmControlStop        = 0x03
+	fstrmControlReady       = 0x04
+	fstrmControlFinish      = 0x05
+	fstrmControlContentType = 0x01
+)
+
+// dnstap message types, socket families and protocols from dnstap.proto.
+const (
+	dnstapTypeMessage    = 1
+	dnstapClientQuery    = 5
+	dnstapClientResponse = 6
+	dnstapFamilyINET     = 1
+	dnstapFamilyINET6    = 2
+	dnstapProtocolUDP    = 1
+	dnstapProtocolTCP    = 2
+	dnstapProtocolDOQ    = 7
+)
+
+// dnstapWriter sends dnstap messages to a Unix socket using the bidirectional
+// Frame Streams protocol. Messages are queued and dropped if the socket can't
+// keep up or is unreachable, so that queries never wait for it.
+type dnstapWriter struct {
+	path     string
+	identity []byte
+	frames   chan []byte
+	dropped  atomic.Uint64
+}
+
+func newDnstapWriter(path string) *dnstapWriter {
+	hostname, _ := os.Hostname()
+	return &dnstapWriter{
+		path:     path,
+		identity: []byte(hostname),
+		frames:   make(chan []byte, dnstapQueueSize),
+	}
+}
+
+// send queues the message, or drops it if the queue is full.
+func (t *dnstapWriter) send(frame []byte) {
+	select {
+	case t.frames <- frame:
+	default:
+		t.dropped.Add(1)
+	}
+}
+
+// run writes the queued messages to the socket until ctx is canceled,
+// reconnecting whenever the connection fails.
+func (t *dnstapWriter) run(ctx context.Context) error {
+	for {
+		err := t.connect(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		slog.Warn(
+			"dnstap socket failed, dropping messages until it reconnects",
+			"path", t.path,
+			"retry_in", dnstapRetryDelay,
+			"dropped", t.dropped.Load(),
+			"err", err)
+
+		timer := time.NewTimer(dnstapRetryDelay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+
+		// Drop what was queued while disconnected, since it is stale.
+		for len(t.frames) > 0 {
+			<-t.frames
+			t.dropped.Add(1)
+		}
+	}
+}
+
+// connect dials the socket and writes messages to it until it fails or ctx is
+// canceled.
+func (t *dnstapWriter) connect(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", t.path)
+	if err != nil {
+		return fmt.Errorf("failed to dial dnstap socket: %w", err)
+	}
+	defer conn.Close()
+
+	w := bufio.NewWriter(conn)
+	r := bufio.NewReader(conn)
+
+	conn.SetDeadline(time.Now().Add(dnstapTimeout))
+	if err := writeControlFrame(w, fstrmControlReady); err != nil {
+		return err
+	}
+	if err := readControlFrame(r, fstrmControlAccept); err != nil {
+		return err
+	}
+	if err := writeControlFrame(w, fstrmControlStart); err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	slog.Info(
+		"connected to dnstap socket",
+		"path", t.path)
+
+	for {
+		select {
+		case <-ctx.Done():
+			// Tell the reader that we are done, but don't wait long for it.
+			conn.SetDeadline(time.Now().Add(time.Second))
+			if err := writeControlFrame(w, fstrmControlStop); err != nil {
+				return err
+			}
+			return readControlFrame(r, fstrmControlFinish)
+		case frame := <-t.frames:
+			conn.SetWriteDeadline(time.Now().Add(dnstapTimeout))
+			if err := writeDataFrame(w, frame); err != nil {
+				return err
+			}
+			for len(t.frames) > 0 {
+				if err := writeDataFrame(w, <-t.frames); err != nil {
+					return err
+				}
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func writeDataFrame(w *bufio.Writer, frame []byte) error {
+	w.Write(binary.BigEndian.AppendUint32(nil, uint32(len(frame))))
+	_, err := w.Write(frame)
+	return err
+}
+
+// writeControlFrame writes a control frame of the given type. All frames but
+// STOP carry the content type.
+func writeControlFrame(w *bufio.Writer, typ uint32) error {
+	frame := binary.BigEndian.AppendUint32(nil, typ)
+	if typ != fstrmControlStop {
+		frame = binary.BigEndian.AppendUint32(frame, fstrmControlContentType)
+		frame = binary.BigEndian.AppendUint32(frame, uint32(len(dnstapContentType)))
+		frame = append(frame, dnstapContentType...)
+	}
+
+	// Control frames are escaped by a data frame length of 0.
+	header := binary.BigEndian.AppendUint32(nil, 0)
+	header = binary.BigEndian.AppendUint32(header, uint32(len(frame)))
+	w.Write(header)
+	w.Write(frame)
+	return w.Flush()
+}
+
+// readControlFrame reads a control frame and checks that it is of the given
+// type. Its fields are ignored, since we only ever offer one content type.
+func readControlFrame(r *bufio.Reader, want uint32) error {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return fmt.Errorf("failed to read dnstap control frame: %w", err)
+	}
+	if binary.BigEndian.Uint32(header[:4]) != 0 {
+		return errors.New("dnstap socket sent a data frame instead of a control frame")
+	}
+
+	n := binary.BigEndian.Uint32(header[4:])
+	if n < 4 || n > dnstapMaxControlFrameLen {
+		return fmt.Errorf("invalid dnstap control frame length %d", n)
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return fmt.Errorf("failed to read dnstap control frame: %w", err)
+	}
+
+	if typ := binary.BigEndian.Uint32(frame); typ != want {
+		return fmt.Errorf("dnstap socket sent control frame %d instead of %d", typ, want)
+	}
+	return nil
+}
+
+// dnstapHandler sends a CLIENT_QUERY message for every query to h and a
+// CLIENT_RESPONSE message for every response of h to t.
+func dnstapHandler(t *dnstapWriter, h dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		tw := &dnstapResponseWriter{ResponseWriter: w, tap: t, queryTime: time.Now()}
+		if query, err := req.Pack(); err == nil {
+			tw.query = query
+			t.send(tw.frame(dnstapClientQuery, time.Time{}, nil))
+		}
+		h.ServeDNS(tw, req)
+	})
+}
+
+type dnstapResponseWriter struct {
+	dns.ResponseWriter
+	tap       *dnstapWriter
+	query     []byte
+	queryTime time.Time
+}
+
+func (w *dnstapResponseWriter) Unwrap() dns.ResponseWriter { return w.ResponseWriter }
+
+func (w *dnstapResponseWriter) WriteMsg(m *dns.Msg) error {
+	if resp, err := m.Pack(); err == nil {
+		w.tap.send(w.frame(dnstapClientResponse, time.Now(), resp))
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+func (w *dnstapResponseWriter) Write(b []byte) (int, error) {
+	w.tap.send(w.frame(dnstapClientResponse, time.Now(), b))
+	return w.ResponseWriter.Write(b)
+}
+
+// frame encodes a dnstap message of the given type. Responses also carry the
+// query, so that the time that they took can be told.
+func (w *dnstapResponseWriter) frame(typ uint64, respTime time.Time, resp []byte) []byte {
+	client, _ := netip.ParseAddrPort(w.RemoteAddr().String())
+	server, _ := netip.ParseAddrPort(w.LocalAddr().String())
+
+	family := uint64(dnstapFamilyINET6)
+	if client.Addr().Unmap().Is4() {
+		family = dnstapFamilyINET
+		client = netip.AddrPortFrom(client.Addr().Unmap(), client.Port())
+		server = netip.AddrPortFrom(server.Addr().Unmap(), server.Port())
+	}
+
+	var protocol uint64
+	switch w.RemoteAddr().Network() {
+	case "udp":
+		protocol = dnstapProtocolUDP
+	case "tcp":
+		protocol = dnstapProtocolTCP
+	case "doq":
+		protocol = dnstapProtocolDOQ
+	}
+
+	var msg []byte
+	msg = protoVarint(msg, 1, typ)
+	msg = protoVarint(msg, 2, family)
+	if protocol != 0 {
+		msg = protoVarint(msg, 3, protocol)
+	}
+	if client.IsValid() {
+		msg = protoBytes(msg, 4, client.Addr().AsSlice())
+		msg = protoVarint(msg, 6, uint64(client.Port()))
+	}
+	if server.IsValid() {
+		msg = protoBytes(msg, 5, server.Addr().AsSlice())
+		msg = protoVarint(msg, 7, uint64(server.Port()))
+	}
+	msg = protoVarint(msg, 8, uint64(w.queryTime.Unix()))
+	msg = protoFixed32(msg, 9, uint32(w.queryTime.Nanosecond()))
+	msg = protoBytes(msg, 10, w.query)
+	if resp != nil {
+		msg = protoVarint(msg, 12, uint64(respTime.Unix()))
+		msg = protoFixed32(msg, 13, uint32(respTime.Nanosecond()))
+		msg = protoBytes(msg, 14, resp)
+	}
+
+	var frame []byte
+	frame = protoBytes(frame, 1, w.tap.identity)
+	frame = protoBytes(frame, 2, []byte("cname-serve"))
+	frame = protoBytes(frame, 14, msg)
+	frame = protoVarint(frame, 15, dnstapTypeMessage)
+	return frame
+}
+
+// protoVarint, protoFixed32 and protoBytes append a protobuf field to b, which
+// is all that is needed to encode dnstap messages. TestDnstap checks the
+// encoding against testdata/dnstap.proto.
+func protoVarint(b []byte, field int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3)
+	return binary.AppendUvarint(b, v)
+}
+
+func protoFixed32(b []byte, field int, v uint32) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|5)
+	return binary.LittleEndian.AppendUint32(b, v)
+}
+
+func protoBytes(b []byte, field int, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bufbuild/protocompile"
+	"github.com/miekg/dns"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// TestDnstap runs a collector that speaks Frame Streams and decodes the
+// messages with testdata/dnstap.proto.
+func TestDnstap(t *testing.T) {
+	schema := compileDnstapProto(t)
+
+	path := filepath.Join(t.TempDir(), "dnstap.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tap := newDnstapWriter(path)
+	done := make(chan error, 1)
+	go func() { done <- tap.run(ctx) }()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+
+	// The bidirectional handshake.
+	expectControlFrame(t, r, fstrmControlReady, true)
+	writeTestControlFrame(t, conn, fstrmControlAccept)
+	expectControlFrame(t, r, fstrmControlStart, true)
+
+	handler := dnstapHandler(tap, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP("192.0.2.1"),
+		})
+		w.WriteMsg(resp)
+	}))
+	req := new(dns.Msg)
+	req.SetQuestion("www.a.test.", dns.TypeA)
+	resp := exchange(t, handler, req)
+
+	hostname, _ := os.Hostname()
+	for i, want := range []struct {
+		typ  string
+		resp *dns.Msg
+	}{
+		{"CLIENT_QUERY", nil},
+		{"CLIENT_RESPONSE", resp},
+	} {
+		frame := readTestDataFrame(t, r)
+
+		d := dynamicpb.NewMessage(schema)
+		// Unmarshal also fails if a required field is missing.
+		if err := proto.Unmarshal(frame, d); err != nil {
+			t.Fatalf("frame %d: failed to decode dnstap message: %v", i, err)
+		}
+
+		if got := enumName(d, "type"); got != "MESSAGE" {
+			t.Errorf("frame %d: got type %s, want MESSAGE", i, got)
+		}
+		if got := string(field(d, "identity").Bytes()); got != hostname {
+			t.Errorf("frame %d: got identity %q, want %q", i, got, hostname)
+		}
+		if got := string(field(d, "version").Bytes()); got != "cname-serve" {
+			t.Errorf("frame %d: got version %q", i, got)
+		}
+
+		m := field(d, "message").Message()
+		if got := enumName(m, "type"); got != want.typ {
+			t.Errorf("frame %d: got message type %s, want %s", i, got, want.typ)
+		}
+		if got := enumName(m, "socket_family"); got != "INET" {
+			t.Errorf("frame %d: got socket family %s, want INET", i, got)
+		}
+		if got := enumName(m, "socket_protocol"); got != "UDP" {
+			t.Errorf("frame %d: got socket protocol %s, want UDP", i, got)
+		}
+
+		client, _ := netip.AddrFromSlice(field(m, "query_address").Bytes())
+		server, _ := netip.AddrFromSlice(field(m, "response_address").Bytes())
+		if client != netip.MustParseAddr("127.0.0.1") || field(m, "query_port").Uint() != 12345 {
+			t.Errorf("frame %d: got query address %v port %d", i, client, field(m, "query_port").Uint())
+		}
+		if server != netip.MustParseAddr("127.0.0.1") || field(m, "response_port").Uint() != 53 {
+			t.Errorf("frame %d: got response address %v port %d", i, server, field(m, "response_port").Uint())
+		}
+
+		queryTime := time.Unix(int64(field(m, "query_time_sec").Uint()), int64(field(m, "query_time_nsec").Uint()))
+		if time.Since(queryTime).Abs() > time.Minute {
+			t.Errorf("frame %d: got query time %v", i, queryTime)
+		}
+
+		assertDNSMessage(t, field(m, "query_message").Bytes(), req)
+		if want.resp == nil {
+			if m.Has(m.Descriptor().Fields().ByName("response_message")) {
+				t.Errorf("frame %d: query has a response message", i)
+			}
+			continue
+		}
+		assertDNSMessage(t, field(m, "response_message").Bytes(), want.resp)
+		respTime := time.Unix(int64(field(m, "response_time_sec").Uint()), int64(field(m, "response_time_nsec").Uint()))
+		if respTime.Before(queryTime) {
+			t.Errorf("frame %d: response time %v is before query time %v", i, respTime, queryTime)
+		}
+	}
+
+	// Shutting down stops the stream and waits for FINISH.
+	cancel()
+	expectControlFrame(t, r, fstrmControlStop, false)
+	writeTestControlFrame(t, conn, fstrmControlFinish)
+	if err := <-done; err != nil {
+		t.Errorf("dnstap writer failed: %v", err)
+	}
+}
+
+func compileDnstapProto(t *testing.T) protoreflect.MessageDescriptor {
+	t.Helper()
+	compiler := protocompile.Compiler{
+		Resolver: &protocompile.SourceResolver{ImportPaths: []string{"testdata"}},
+	}
+	files, err := compiler.Compile(context.Background(), "dnstap.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files[0].Messages().ByName("Dnstap")
+}
+
+func field(m protoreflect.Message, name protoreflect.Name) protoreflect.Value {
+	return m.Get(m.Descriptor().Fields().ByName(name))
+}
+
+func enumName(m protoreflect.Message, name protoreflect.Name) string {
+	fd := m.Descriptor().Fields().ByName(name)
+	value := fd.Enum().Values().ByNumber(m.Get(fd).Enum())
+	if value == nil {
+		return ""
+	}
+	return string(value.Name())
+}
+
+func assertDNSMessage(t *testing.T, b []byte, want *dns.Msg) {
+	t.Helper()
+	got := new(dns.Msg)
+	if err := got.Unpack(b); err != nil {
+		t.Errorf("failed to unpack DNS message: %v", err)
+		return
+	}
+	if got.String() != want.String() {
+		t.Errorf("got DNS message\n%v\nwant\n%v", got, want)
+	}
+}
+
+// expectControlFrame reads a Frame Streams control frame of the given type,
+// which carries the dnstap content type if contentType is true.
+func expectControlFrame(t *testing.T, r io.Reader, typ uint32, contentType bool) {
+	t.Helper()
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		t.Fatal(err)
+	}
+	if escape := binary.BigEndian.Uint32(header[:4]); escape != 0 {
+		t.Fatalf("got a data frame of %d bytes, want control frame %d", escape, typ)
+	}
+	frame := make([]byte, binary.BigEndian.Uint32(header[4:]))
+	if _, err := io.ReadFull(r, frame); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := binary.BigEndian.Uint32(frame); got != typ {
+		t.Fatalf("got control frame %d, want %d", got, typ)
+	}
+
+	var types [][]byte
+	for fields := frame[4:]; len(fields) > 0; {
+		if len(fields) < 8 || binary.BigEndian.Uint32(fields) != fstrmControlContentType {
+			t.Fatalf("invalid fields in control frame %d: %x", typ, fields)
+		}
+		n := binary.BigEndian.Uint32(fields[4:])
+		types = append(types, fields[8:8+n])
+		fields = fields[8+n:]
+	}
+	switch {
+	case contentType && (len(types) != 1 || !bytes.Equal(types[0], []byte(dnstapContentType))):
+		t.Errorf("control frame %d has content types %q, want %q", typ, types, dnstapContentType)
+	case !contentType && len(types) > 0:
+		t.Errorf("control frame %d has content types %q", typ, types)
+	}
+}
+
+func writeTestControlFrame(t *testing.T, w io.Writer, typ uint32) {
+	t.Helper()
+	frame := binary.BigEndian.AppendUint32(nil, typ)
+	frame = binary.BigEndian.AppendUint32(frame, fstrmControlContentType)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(dnstapContentType)))
+	frame = append(frame, dnstapContentType...)
+
+	b := binary.BigEndian.AppendUint32(nil, 0)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(frame)))
+	if _, err := w.Write(append(b, frame...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestDataFrame(t *testing.T, r io.Reader) []byte {
+	t.Helper()
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		t.Fatal(err)
+	}
+	n := binary.BigEndian.Uint32(header[:])
+	if n == 0 {
+		t.Fatal("got a control frame, want a data frame")
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// DoQ error codes as defined in RFC 9250, section 8.4.
+const (
+	doqNoError       = 0x0
+	doqInternalError = 0x1
+	doqProtocolError = 0x2
+)
+
+const doqReadTimeout = 5 * time.Second
+
+// doqServer serves DNS over QUIC as defined in RFC 9250.
+type doqServer struct {
+	Handler dns.Handler
+	// PaddingBlockSize, if not 0, pads responses to a multiple of it as
+	// defined in RFC 7830 if the query was padded or if PadResponses is true.
+	PaddingBlockSize int
+	PadResponses     bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newDoQServer(handler dns.Handler) *doqServer {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &doqServer{
+		Handler: handler,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+// Serve serves DoQ on the given UDP connection until Shutdown is called. The
+// connection is not closed.
+func (s *doqServer) Serve(conn net.PacketConn, tlsConfig *tls.Config) error {
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{"doq"}
+
+	l, err := quic.Listen(conn, tlsConfig, &quic.Config{
+		MaxIdleTimeout: 30 * time.Second,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to listen to QUIC: %w", err)
+	}
+	defer l.Close()
+
+	for {
+		conn, err := l.Accept(s.ctx)
+		if err != nil {
+			if s.ctx.Err() != nil {
+				s.wg.Wait()
+				return nil
+			}
+			return fmt.Errorf("failed to accept QUIC connection: %w", err)
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.serveConn(conn)
+		}()
+	}
+}
+
+// Shutdown stops accepting new connections and streams. Serve returns once all
+// in-flight streams have been handled.
+func (s *doqServer) Shutdown() error {
+	s.cancel()
+	return nil
+}
+
+func (s *doqServer) serveConn(conn quic.Connection) {
+	var wg sync.WaitGroup
+
+	for {
+		stream, err := conn.AcceptStream(s.ctx)
+		if err != nil {
+			wg.Wait()
+			if s.ctx.Err() != nil {
+				conn.CloseWithError(doqNoError, "")
+			}
+			return
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.serveStream(conn, stream); err != nil {
+				slog.Debug(
+					"DoQ protocol error",
+					"remote_addr", conn.RemoteAddr(),
+					"err", err)
+				conn.CloseWithError(doqProtocolError, err.Error())
+			}
+		}()
+	}
+}
+
+func (s *doqServer) serveStream(conn quic.Connection, stream quic.Stream) error {
+	stream.SetReadDeadline(time.Now().Add(doqReadTimeout))
+
+	var size uint16
+	if err := binary.Read(stream, binary.BigEndian, &size); err != nil {
+		return fmt.Errorf("failed to read message length: %w", err)
+	}
+
+	b := make([]byte, size)
+	if _, err := io.ReadFull(stream, b); err != nil {
+		return fmt.Errorf("failed to read message: %w", err)
+	}
+
+	req := new(dns.Msg)
+	if err := req.Unpack(b); err != nil {
+		return fmt.Errorf("failed to unpack message: %w", err)
+	}
+
+	// RFC 9250, section 4.2.1: the message ID must be 0.
+	if req.Id != 0 {
+		return errors.New("message ID is not 0")
+	}
+
+	if req.Response || req.Opcode != dns.OpcodeQuery || len(req.Question) != 1 {
+		stream.CancelRead(doqProtocolError)
+		stream.CancelWrite(doqProtocolError)
+		return nil
+	}
+
+	w := &doqResponseWriter{conn: conn, stream: stream}
+	if opt := req.IsEdns0(); opt != nil && (s.PadResponses || hasEDNS0Padding(opt)) {
+		w.padding = s.PaddingBlockSize
+	}
+	s.Handler.ServeDNS(w, req)
+
+	if !w.written {
+		stream.CancelWrite(doqInternalError)
+	}
+	return nil
+}
+
+// doqAddr wraps the remote address of a DoQ connection so that its network is
+// not reported as "udp". This prevents the handlers from applying UDP
+// truncation to DoQ responses.
+type doqAddr struct{ net.Addr }
+
+func (a doqAddr) Network() string { return "doq" }
+
+// doqResponseWriter implements dns.ResponseWriter for a single DoQ stream.
+type doqResponseWriter struct {
+	conn    quic.Connection
+	stream  quic.Stream
+	padding int
+	written bool
+}
+
+var _ dns.ResponseWriter = (*doqResponseWriter)(nil)
+
+func (w *doqResponseWriter) LocalAddr() net.Addr  { return doqAddr{w.conn.LocalAddr()} }
+func (w *doqResponseWriter) RemoteAddr() net.Addr { return doqAddr{w.conn.RemoteAddr()} }
+
+func (w *doqResponseWriter) WriteMsg(m *dns.Msg) error {
+	// The response must also carry a message ID of 0.
+	m.Id = 0
+
+	if w.padding > 0 {
+		padMsg(m, w.padding)
+	}
+
+	b, err := m.Pack()
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(b)
+	return err
+}
+
+func (w *doqResponseWriter) Write(b []byte) (int, error) {
+	if len(b) > dns.MaxMsgSize {
+		return 0, fmt.Errorf("message too large: %d bytes", len(b))
+	}
+
+	msg := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(msg, uint16(len(b)))
+	copy(msg[2:], b)
+
+	if _, err := w.stream.Write(msg); err != nil {
+		return 0, err
+	}
+
+	w.written = true
+	return len(b), w.stream.Close()
+}
+
+func (w *doqResponseWriter) Close() error {
+	w.stream.CancelRead(doqNoError)
+	return w.stream.Close()
+}
+
+func (w *doqResponseWriter) TsigStatus() error   { return nil }
+func (w *doqResponseWriter) TsigTimersOnly(bool) {}
+func (w *doqResponseWriter) Hijack()             {}
+
+func hasEDNS0Padding(opt *dns.OPT) bool {
+	return slices.ContainsFunc(opt.Option, func(o dns.EDNS0) bool {
+		return o.Option() == dns.EDNS0PADDING
+	})
+}
+
+// padMsg pads the message to a multiple of blockSize using the EDNS(0) padding
+// option as defined in RFC 7830. Messages without an OPT record are left as-is.
+func padMsg(m *dns.Msg, blockSize int) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+
+	opt.Option = slices.DeleteFunc(opt.Option, func(o dns.EDNS0) bool {
+		return o.Option() == dns.EDNS0PADDING
+	})
+
+	padding := &dns.EDNS0_PADDING{}
+	opt.Option = append(opt.Option, padding)
+
+	if n := m.Len() % blockSize; n != 0 {
+		padding.Padding = make([]byte, blockSize-n)
+	}
+}
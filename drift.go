@@ -0,0 +1,109 @@
+package main
+
+import (
+	"container/list"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// targetDrift remembers the addresses that every finalized target last
+// resolved to, and warns when they change. This gives early notice of changes
+// to the upstream records of targets, such as migrations or hijacks.
+type targetDrift struct {
+	mu   sync.Mutex
+	last map[resolveCacheKey]*list.Element // of *driftEntry
+	lru  *list.List                        // most recently observed first
+
+	// changes counts the changes of the addresses of all targets.
+	changes atomic.Uint64
+}
+
+type driftEntry struct {
+	key   resolveCacheKey
+	addrs []string
+}
+
+func newTargetDrift() *targetDrift {
+	return &targetDrift{
+		last: make(map[resolveCacheKey]*list.Element),
+		lru:  list.New(),
+	}
+}
+
+// observe records the freshly resolved addresses of the target and warns if
+// they differ from the addresses that it resolved to before. If maxEntries is
+// not 0, then only that many of the most recently observed targets are
+// remembered, since clients may choose the targets of rewrite rules. It does
+// nothing if d is nil.
+func (d *targetDrift) observe(key resolveCacheKey, ips []net.IP, maxEntries int) {
+	if d == nil {
+		return
+	}
+
+	current := make([]string, len(ips))
+	for i, ip := range ips {
+		current[i] = ip.String()
+	}
+	slices.Sort(current)
+	current = slices.Compact(current)
+
+	d.mu.Lock()
+	var previous []string
+	elem, seen := d.last[key]
+	if seen {
+		entry := elem.Value.(*driftEntry)
+		previous, entry.addrs = entry.addrs, current
+		d.lru.MoveToFront(elem)
+	} else {
+		d.last[key] = d.lru.PushFront(&driftEntry{key: key, addrs: current})
+	}
+	for maxEntries > 0 && d.lru.Len() > maxEntries {
+		oldest := d.lru.Remove(d.lru.Back()).(*driftEntry)
+		delete(d.last, oldest.key)
+	}
+	d.mu.Unlock()
+
+	if !seen || slices.Equal(previous, current) {
+		return
+	}
+	d.changes.Add(1)
+
+	slog.Warn(
+		"resolved addresses of target changed",
+		"target", key.target,
+		"network", key.network,
+		"previous", previous,
+		"current", current,
+		"added", missingFrom(previous, current),
+		"removed", missingFrom(current, previous))
+}
+
+// forget drops the addresses of the target, such as once it is no longer
+// served. It does nothing if d is nil.
+func (d *targetDrift) forget(key resolveCacheKey) {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if elem, ok := d.last[key]; ok {
+		d.lru.Remove(elem)
+		delete(d.last, key)
+	}
+}
+
+// missingFrom returns the elements of b that are not in the sorted slice a.
+func missingFrom(a, b []string) []string {
+	var missing []string
+	for _, s := range b {
+		if _, found := slices.BinarySearch(a, s); !found {
+			missing = append(missing, s)
+		}
+	}
+	return missing
+}
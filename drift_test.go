@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestTargetDriftMaxEntries(t *testing.T) {
+	drift := newTargetDrift()
+	ips := []net.IP{net.ParseIP("192.0.2.1")}
+
+	for _, target := range []string{"a.example.net.", "b.example.net.", "c.example.net."} {
+		drift.observe(resolveCacheKey{target: target, network: "ip4"}, ips, 2)
+	}
+	if n := len(drift.last); n != 2 {
+		t.Errorf("remembered %d targets, want 2", n)
+	}
+	if _, ok := drift.last[resolveCacheKey{target: "a.example.net.", network: "ip4"}]; ok {
+		t.Error("the least recently observed target was kept")
+	}
+
+	drift.forget(resolveCacheKey{target: "b.example.net.", network: "ip4"})
+	if n := len(drift.last); n != 1 {
+		t.Errorf("remembered %d targets after forgetting one, want 1", n)
+	}
+}
+
+func TestTargetDriftNoCache(t *testing.T) {
+	cfg := testConfig(t, `
+finalize = true
+finalize_cache_ttl = "1m"
+report_target_drift = true
+
+[zones."a.test"]
+www = { target = "www.example.net", no_cache = true }
+`)
+	resolver := staticResolver{"www.example.net.": {net.ParseIP("192.0.2.1")}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	drift := newTargetDrift()
+	store, err := newZoneStore(ctx, cfg, zoneSetOptions{
+		Hostname:    "ns.test",
+		Resolver:    resolver,
+		TargetDrift: drift,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := newZoneHandler(store, nil)
+
+	query(t, handler, "www.a.test.", dns.TypeA)
+	resolver["www.example.net."] = []net.IP{net.ParseIP("192.0.2.2")}
+	query(t, handler, "www.a.test.", dns.TypeA)
+
+	if n := drift.changes.Load(); n != 1 {
+		t.Errorf("got %d changes, want 1", n)
+	}
+}
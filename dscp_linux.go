@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strings"
+	"syscall"
+)
+
+// dscpControl returns a [net.ListenConfig] Control function that marks the
+// packets sent from sockets with the given DSCP value using IP_TOS and
+// IPV6_TCLASS.
+func dscpControl(dscp int) (func(network, address string, c syscall.RawConn) error, error) {
+	tos := dscp << 2
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			if strings.HasSuffix(network, "6") {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos)
+				if sockErr != nil {
+					return
+				}
+			}
+			// IPv6 sockets may also carry IPv4 traffic, which is only marked
+			// with IP_TOS. Dual-stack sockets may refuse it, which is fine.
+			err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+			if !strings.HasSuffix(network, "6") {
+				sockErr = err
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}, nil
+}
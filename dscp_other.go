@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+func dscpControl(dscp int) (func(network, address string, c syscall.RawConn) error, error) {
+	return nil, errors.New("dscp is only supported on Linux")
+}
@@ -0,0 +1,45 @@
+package main
+
+import "github.com/miekg/dns"
+
+// ednsBufferSize is the UDP buffer size that is advertised in responses that
+// are not created by newdns, which is also its default.
+const ednsBufferSize = 1220
+
+// newResponse returns an empty response to req for responses that are not
+// created by newdns. Like newdns, it echoes an OPT record if the client
+// supports EDNS, which RFC 6891 requires.
+func newResponse(req *dns.Msg) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	if req.IsEdns0() != nil {
+		resp.SetEdns0(ednsBufferSize, false)
+	}
+	return resp
+}
+
+// errorResponse returns a response to req with the given rcode and, if the
+// client supports EDNS, the given Extended DNS Error.
+func errorResponse(req *dns.Msg, rcode int, ede uint16, text string) *dns.Msg {
+	resp := newResponse(req)
+	resp.Rcode = rcode
+	setExtendedError(req, resp, ede, text)
+	return resp
+}
+
+// setExtendedError adds an Extended DNS Error (RFC 8914) with the given info
+// code and optional text to the response, so that clients and resolvers in
+// front of us can tell why a query failed. Nothing is added if the client
+// does not support EDNS.
+func setExtendedError(req, resp *dns.Msg, code uint16, text string) {
+	if req.IsEdns0() == nil {
+		return
+	}
+
+	opt := resp.IsEdns0()
+	if opt == nil {
+		resp.SetEdns0(ednsBufferSize, false)
+		opt = resp.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: code, ExtraText: text})
+}
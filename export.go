@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/256dpi/newdns"
+	"github.com/miekg/dns"
+)
+
+// runExport writes the records that are served for the configured zones to
+// stdout as BIND zone files. If zones are given, then only those are exported.
+func runExport(ctx context.Context, zones []string) int {
+	cfg, err := ParseConfigFile(configPath, strictConfig)
+	if err != nil {
+		slog.Error(
+			"failed to parse config file",
+			"path", configPath,
+			"err", err)
+		return 1
+	}
+
+	set, err := buildConfigZoneSet(ctx, cfg)
+	if err != nil {
+		slog.Error(
+			"failed to build zones",
+			"err", err)
+		return 1
+	}
+
+	for i, zone := range zones {
+		zones[i] = newdns.NormalizeDomain(zone, true, true, false)
+	}
+
+	// Export the serial that is currently served if it is saved, or the serial
+	// that serving would start with otherwise.
+	serial := nextSerial(cfg.Serial, 0, time.Now())
+	if cfg.Serial != serialFixed && cfg.SerialFile != "" {
+		saved, err := loadSerial(cfg.SerialFile)
+		if err != nil {
+			slog.Error(
+				"failed to load serial",
+				"err", err)
+			return 1
+		}
+		if saved > 0 {
+			serial = saved
+		}
+	}
+
+	exported := slices.Clone(set.zones)
+	slices.SortFunc(exported, func(a, b servedZone) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	if len(zones) > 0 {
+		exported = slices.DeleteFunc(exported, func(z servedZone) bool {
+			return !slices.Contains(zones, z.Name)
+		})
+		if len(exported) == 0 {
+			slog.Error(
+				"no such zones",
+				"zones", zones)
+			return 1
+		}
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	for _, zone := range exported {
+		if err := writeZoneFile(out, cfg, zone.Zone, serial, set.names[zone.Name]); err != nil {
+			slog.Error(
+				"failed to export zone",
+				"zone", zone.Name,
+				"err", err)
+			return 1
+		}
+	}
+
+	if err := out.Flush(); err != nil {
+		slog.Error(
+			"failed to write zone files",
+			"err", err)
+		return 1
+	}
+
+	return 0
+}
+
+// buildConfigZoneSet builds the zones that are served for the config without
+// serving them. Zones from dynamic sources such as Consul are not included.
+func buildConfigZoneSet(ctx context.Context, cfg *Config) (*zoneSet, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get hostname: %w", err)
+	}
+
+	zcfgs := cfg.Zones
+	if cfg.HostsFile != "" {
+		hosts, err := parseHostsFile(cfg.HostsFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load hosts file: %w", err)
+		}
+		zcfgs = mergeZones(zcfgs, hosts)
+	}
+
+	return buildZoneSet(ctx, cfg, zcfgs, zoneSetOptions{
+		Hostname: hostname,
+		Resolver: finalizeResolver(cfg),
+	})
+}
+
+// writeZoneFile writes the zone in the BIND master file format. Names that
+// fail to resolve are written as comments.
+func writeZoneFile(w io.Writer, cfg *Config, zone newdns.Zone, serial uint32, names map[string]*nameEntry) error {
+	if err := zone.Validate(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "$ORIGIN %s\n", zone.Name)
+	fmt.Fprintf(w, "$TTL %d\n", uint32(max(time.Duration(cfg.Expire), zone.MinTTL)/time.Second))
+
+	// writeLine writes the record with the TTL that it is served with.
+	writeLine := func(rr dns.RR) {
+		applyMinTTLs(&dns.Msg{Answer: []dns.RR{rr}}, cfg)
+		fmt.Fprintln(w, rr)
+	}
+
+	soa := zoneSOA(zone, serial)
+	applyMinTTLs(&dns.Msg{Answer: []dns.RR{soa}}, cfg)
+	if cfg.NegativeTTL > 0 {
+		setNegativeTTL(&dns.Msg{Answer: []dns.RR{soa}}, time.Duration(cfg.NegativeTTL))
+	}
+	fmt.Fprintln(w, soa)
+
+	for _, ns := range slices.Compact(slices.Clone(zone.AllNameServers)) {
+		writeLine(&dns.NS{
+			Hdr: zoneRRHeader(zone.Name, dns.TypeNS, zone.NSTTL),
+			Ns:  ns,
+		})
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(names)) {
+		if note := names[name].note; note != "" {
+			for _, line := range strings.Split(note, "\n") {
+				fmt.Fprintf(w, "; %s\n", line)
+			}
+		}
+		if rcode := names[name].rcode; rcode != 0 {
+			fmt.Fprintf(w, "; %s: answered with %s\n", joinDomain(name, zone.Name), dns.RcodeToString[rcode])
+			continue
+		}
+		if len(names[name].records) > 0 {
+			ttl := names[name].expire(cfg)
+			if ttl > 0 {
+				ttl = max(ttl, zone.MinTTL)
+			}
+			for _, rr := range entryRecords(names[name], joinDomain(name, zone.Name), ttl) {
+				writeLine(rr)
+			}
+			continue
+		}
+
+		sets, err := zone.Handler(name)
+		if err != nil {
+			fmt.Fprintf(w, "; %s: %v\n", joinDomain(name, zone.Name), err)
+			continue
+		}
+
+		for _, set := range sets {
+			// A TTL of 0 is kept, see [clearZeroTTLs].
+			ttl := set.TTL
+			if names[name].expire(cfg) > 0 {
+				ttl = max(ttl, zone.MinTTL)
+			}
+			for _, record := range set.Records {
+				rr, err := setRecordToRR(set, record, ttl)
+				if err != nil {
+					return fmt.Errorf("invalid record for %q: %w", set.Name, err)
+				}
+				writeLine(rr)
+			}
+		}
+	}
+
+	_, err := fmt.Fprintln(w)
+	return err
+}
+
+func zoneRRHeader(name string, rrtype uint16, ttl time.Duration) dns.RR_Header {
+	return dns.RR_Header{
+		Name:   name,
+		Rrtype: rrtype,
+		Class:  dns.ClassINET,
+		Ttl:    uint32(ttl / time.Second),
+	}
+}
+
+// setRecordToRR converts a record of a newdns set into the RR that newdns would
+// serve for it.
+func setRecordToRR(set newdns.Set, record newdns.Record, ttl time.Duration) (dns.RR, error) {
+	hdr := zoneRRHeader(set.Name, uint16(set.Type), ttl)
+
+	switch set.Type {
+	case newdns.A:
+		return &dns.A{Hdr: hdr, A: net.ParseIP(record.Address)}, nil
+	case newdns.AAAA:
+		return &dns.AAAA{Hdr: hdr, AAAA: net.ParseIP(record.Address)}, nil
+	case newdns.CNAME:
+		return &dns.CNAME{Hdr: hdr, Target: dns.Fqdn(record.Address)}, nil
+	case newdns.MX:
+		return &dns.MX{Hdr: hdr, Preference: uint16(record.Priority), Mx: dns.Fqdn(record.Address)}, nil
+	case newdns.NS:
+		return &dns.NS{Hdr: hdr, Ns: dns.Fqdn(record.Address)}, nil
+	case newdns.TXT:
+		return &dns.TXT{Hdr: hdr, Txt: record.Data}, nil
+	default:
+		return nil, fmt.Errorf("unsupported record type %d", set.Type)
+	}
+}
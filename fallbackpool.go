@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// FallbackPoolConfig configures a pool of fallback resolvers that queries are
+// forwarded to by latency instead of only to fallback_dns.
+type FallbackPoolConfig struct {
+	// Servers are the resolvers of the pool. The pool is disabled if this is
+	// empty.
+	Servers []string `toml:"servers"`
+	// ProbeInterval is how often the latency of every server is measured.
+	ProbeInterval tomlDuration `toml:"probe_interval"`
+	// ProbeTimeout is how long a probe may take before the server is
+	// considered unhealthy.
+	ProbeTimeout tomlDuration `toml:"probe_timeout"`
+}
+
+// fallbackLatencyWeight is the weight of the latest probe in the smoothed
+// latency of a server, so that a single slow probe doesn't move all queries.
+const fallbackLatencyWeight = 0.3
+
+// fallbackPool forwards queries to the fastest healthy server of a pool. The
+// servers are probed periodically by [fallbackPool.Run], which measures their
+// latency and whether they answer at all.
+type fallbackPool struct {
+	cfg     FallbackPoolConfig
+	client  *dns.Client
+	servers []*poolServer
+}
+
+// poolServer is a single server of a fallback pool.
+type poolServer struct {
+	addr  string
+	proxy dns.Handler
+
+	mu      sync.Mutex
+	latency time.Duration // smoothed, 0 until the first probe
+	healthy bool
+}
+
+func newFallbackPool(cfg *Config) *fallbackPool {
+	p := &fallbackPool{
+		cfg:    cfg.FallbackPool,
+		client: &dns.Client{Timeout: time.Duration(cfg.FallbackPool.ProbeTimeout)},
+	}
+	if cfg.FallbackSource.IsValid() {
+		p.client.Dialer = &net.Dialer{
+			LocalAddr: net.UDPAddrFromAddrPort(netip.AddrPortFrom(cfg.FallbackSource, 0)),
+		}
+	}
+	for _, addr := range cfg.FallbackPool.Servers {
+		p.servers = append(p.servers, &poolServer{
+			addr:    addr,
+			proxy:   newProxy(cfg, addr),
+			healthy: true,
+		})
+	}
+	return p
+}
+
+// ServeDNS forwards the query to the fastest healthy server. If no server is
+// healthy, then the first one is tried anyway.
+func (p *fallbackPool) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	p.pick().proxy.ServeDNS(w, req)
+}
+
+func (p *fallbackPool) pick() *poolServer {
+	var best *poolServer
+	var bestLatency time.Duration
+	for _, s := range p.servers {
+		latency, healthy := s.state()
+		if healthy && (best == nil || latency < bestLatency) {
+			best, bestLatency = s, latency
+		}
+	}
+	if best == nil {
+		return p.servers[0]
+	}
+	return best
+}
+
+func (s *poolServer) state() (time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.latency, s.healthy
+}
+
+// Run probes all servers every probe_interval until ctx is canceled.
+func (p *fallbackPool) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(p.cfg.ProbeInterval))
+	defer ticker.Stop()
+
+	for {
+		var wg sync.WaitGroup
+		for _, s := range p.servers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				p.probe(ctx, s)
+			}()
+		}
+		wg.Wait()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe measures the latency of the server by querying it for the NS records
+// of the root zone, which every resolver has cached.
+func (p *fallbackPool) probe(ctx context.Context, s *poolServer) {
+	req := new(dns.Msg)
+	req.SetQuestion(".", dns.TypeNS)
+
+	_, rtt, err := p.client.ExchangeContext(ctx, req, s.addr)
+	if ctx.Err() != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err != nil {
+		if s.healthy {
+			slog.Warn(
+				"fallback server failed its probe, not forwarding to it",
+				"upstream", s.addr,
+				"err", err)
+		}
+		s.healthy = false
+		return
+	}
+
+	if !s.healthy {
+		slog.Info(
+			"fallback server recovered",
+			"upstream", s.addr,
+			"latency", rtt)
+	}
+	s.healthy = true
+	if s.latency == 0 {
+		s.latency = rtt
+	} else {
+		s.latency += time.Duration(fallbackLatencyWeight * float64(rtt-s.latency))
+	}
+}
+
+// stats returns the smoothed latency in milliseconds and the health of every
+// server for the admin API. It returns nil if p is nil.
+func (p *fallbackPool) stats() map[string]any {
+	if p == nil {
+		return nil
+	}
+	stats := make(map[string]any, len(p.servers))
+	for _, s := range p.servers {
+		latency, healthy := s.state()
+		stats[s.addr] = map[string]any{
+			"latency_ms": float64(latency) / float64(time.Millisecond),
+			"healthy":    healthy,
+		}
+	}
+	return stats
+}
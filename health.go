@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/256dpi/newdns"
+)
+
+// nameTarget is a single target of a name with its health state.
+type nameTarget struct {
+	target  string
+	addr    netip.Addr // valid if target is an IP address
+	weight  int
+	check   *url.URL // nil if not health checked
+	healthy atomic.Bool
+}
+
+func newNameTarget(tcfg TargetConfig) (*nameTarget, error) {
+	t := &nameTarget{
+		target: newdns.NormalizeDomain(tcfg.Target, true, true, false),
+		weight: tcfg.Weight,
+	}
+	t.healthy.Store(true)
+
+	if addr, err := netip.ParseAddr(tcfg.Target); err == nil {
+		t.target = addr.String()
+		t.addr = addr
+	}
+
+	if tcfg.Check != "" {
+		u, err := url.Parse(tcfg.Check)
+		if err != nil {
+			return nil, fmt.Errorf("invalid health check URL: %w", err)
+		}
+		switch u.Scheme {
+		case "tcp":
+			if u.Host == "" {
+				return nil, fmt.Errorf("health check %q has no host", tcfg.Check)
+			}
+		case "http", "https":
+		default:
+			return nil, fmt.Errorf("unsupported health check scheme %q", u.Scheme)
+		}
+		t.check = u
+	}
+
+	return t, nil
+}
+
+// selectTargets returns the targets that are currently healthy. If none of them
+// are, then all targets are returned and failOpen is true.
+func selectTargets(targets []*nameTarget) (selected []*nameTarget, failOpen bool) {
+	healthy := make([]*nameTarget, 0, len(targets))
+	for _, t := range targets {
+		if t.healthy.Load() {
+			healthy = append(healthy, t)
+		}
+	}
+	if len(healthy) == 0 {
+		return targets, true
+	}
+	return healthy, false
+}
+
+// pickWeightedTarget picks a random target using the targets' weights.
+func pickWeightedTarget(targets []*nameTarget) *nameTarget {
+	var total int
+	for _, t := range targets {
+		total += t.weight
+	}
+
+	n := rand.IntN(total)
+	for _, t := range targets {
+		n -= t.weight
+		if n < 0 {
+			return t
+		}
+	}
+
+	return targets[len(targets)-1]
+}
+
+// healthChecker periodically runs the health checks of all given targets.
+type healthChecker struct {
+	targets  []*nameTarget
+	interval time.Duration
+	timeout  time.Duration
+	client   *http.Client
+}
+
+func newHealthChecker(cfg HealthCheckConfig) *healthChecker {
+	return &healthChecker{
+		interval: time.Duration(cfg.Interval),
+		timeout:  time.Duration(cfg.Timeout),
+		client: &http.Client{
+			// Don't follow redirects. A redirect is good enough.
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// Add adds the target to the health checker if it has a health check.
+func (c *healthChecker) Add(t *nameTarget) {
+	if t.check != nil {
+		c.targets = append(c.targets, t)
+	}
+}
+
+// Inherit copies the health of the targets of old to the targets with the same
+// target and check, so that a rebuilt zone set doesn't serve targets that
+// failed their checks until they are checked again.
+func (c *healthChecker) Inherit(old *healthChecker) {
+	healthy := make(map[[2]string]bool, len(old.targets))
+	for _, t := range old.targets {
+		healthy[t.healthKey()] = t.healthy.Load()
+	}
+	for _, t := range c.targets {
+		if h, ok := healthy[t.healthKey()]; ok {
+			t.healthy.Store(h)
+		}
+	}
+}
+
+func (t *nameTarget) healthKey() [2]string {
+	return [2]string{t.target, t.check.String()}
+}
+
+// Run runs the health checks until the context is canceled.
+func (c *healthChecker) Run(ctx context.Context) error {
+	if len(c.targets) == 0 {
+		return nil
+	}
+
+	slog.Info(
+		"health checks starting",
+		"targets", len(c.targets),
+		"interval", c.interval)
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		c.checkAll(ctx)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkAll checks all targets at once and waits for them, so that a slow check
+// is not started again while it is still running, and results of the same
+// target never arrive out of order.
+func (c *healthChecker) checkAll(ctx context.Context) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for _, t := range c.targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			err := c.check(ctx, t.check)
+			if ctx.Err() != nil {
+				return
+			}
+
+			healthy := err == nil
+			if t.healthy.Swap(healthy) == healthy {
+				return
+			}
+
+			slog := slog.With(
+				"target", t.target,
+				"check", t.check.String())
+
+			if healthy {
+				slog.Info(
+					"target is healthy again")
+			} else {
+				slog.Warn(
+					"target failed health check",
+					"err", err)
+			}
+		}()
+	}
+}
+
+func (c *healthChecker) check(ctx context.Context, u *url.URL) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	switch u.Scheme {
+	case "tcp":
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", u.Host)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+
+	case "http", "https":
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unsupported health check scheme %q", u.Scheme)
+	}
+}
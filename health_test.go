@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthKeptAcrossRebuilds(t *testing.T) {
+	cfg := testConfig(t, `
+[zones."a.test"]
+www = { as = "cname", targets = [
+	{ target = "us.example.net", check = "tcp://us.example.net:443" },
+	{ target = "eu.example.net", check = "tcp://eu.example.net:443" },
+] }
+`)
+
+	// The checks never run, since the context is canceled before the zones
+	// are rebuilt.
+	ctx, cancel := context.WithCancel(context.Background())
+	store, err := newZoneStore(ctx, cfg, zoneSetOptions{Hostname: "ns.test", Resolver: staticResolver{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	health := func() map[string]bool {
+		health := make(map[string]bool)
+		for _, target := range store.Zones().checker.targets {
+			health[target.target] = target.healthy.Load()
+		}
+		return health
+	}
+
+	for _, target := range store.Zones().checker.targets {
+		if target.target == "us.example.net." {
+			target.healthy.Store(false)
+		}
+	}
+
+	if err := store.SetConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	got := health()
+	if got["us.example.net."] || !got["eu.example.net."] {
+		t.Errorf("got health %v after rebuilding, want us.example.net. to stay unhealthy", got)
+	}
+
+	// A target with another check is a different target.
+	cfg = testConfig(t, `
+[zones."a.test"]
+www = { as = "cname", targets = [
+	{ target = "us.example.net", check = "tcp://us.example.net:8443" },
+	{ target = "eu.example.net", check = "tcp://eu.example.net:443" },
+] }
+`)
+	if err := store.SetConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got := health(); !got["us.example.net."] {
+		t.Errorf("got health %v after changing the check, want us.example.net. to start healthy", got)
+	}
+}
+
+func TestHealthChecksDontOverlap(t *testing.T) {
+	// The check hangs until it times out, which is longer than the interval.
+	var inflight, maxInflight atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inflight.Add(1)
+		defer inflight.Add(-1)
+		for {
+			m := maxInflight.Load()
+			if n <= m || maxInflight.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	checker := newHealthChecker(HealthCheckConfig{
+		Interval: tomlDuration(10 * time.Millisecond),
+		Timeout:  tomlDuration(50 * time.Millisecond),
+	})
+	target, err := newNameTarget(TargetConfig{Target: "www.example.net", Check: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checker.Add(target)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	checker.Run(ctx)
+
+	if n := maxInflight.Load(); n != 1 {
+		t.Errorf("got %d checks of the target at once, want 1", n)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/256dpi/newdns"
+)
+
+const hostsPollInterval = 5 * time.Second
+
+// loadHostsFile loads the hosts file at path into the store. Each name in the
+// file is placed into the configured zone that it is within, or into a zone of
+// its own if there is none.
+func loadHostsFile(store *zoneStore, path string) error {
+	zones, err := parseHostsFile(path)
+	if err != nil {
+		return err
+	}
+	if err := store.SetDynamicZones("hosts", zones); err != nil {
+		return fmt.Errorf("failed to apply hosts file: %w", err)
+	}
+	return nil
+}
+
+// watchHostsFile reloads the hosts file at path whenever it changes until the
+// context is canceled. The file is polled, so this also works for files that
+// are replaced rather than written to.
+func watchHostsFile(ctx context.Context, store *zoneStore, path string) error {
+	slog := slog.With(
+		"component", "hosts",
+		"path", path)
+
+	last, _ := os.Stat(path)
+
+	ticker := time.NewTicker(hostsPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			if last != nil {
+				slog.Warn(
+					"failed to stat hosts file, keeping the old names",
+					"err", err)
+			}
+			last = nil
+			continue
+		}
+		if last != nil && !fileChanged(last, info) {
+			continue
+		}
+		last = info
+
+		if err := loadHostsFile(store, path); err != nil {
+			slog.Error(
+				"failed to reload hosts file, keeping the old names",
+				"err", err)
+			continue
+		}
+
+		slog.Info(
+			"reloaded hosts file")
+	}
+}
+
+// fileChanged returns whether a file was modified between the two stats of
+// it.
+func fileChanged(old, new fs.FileInfo) bool {
+	return !old.ModTime().Equal(new.ModTime()) || old.Size() != new.Size()
+}
+
+// parseHostsFile parses a file in the /etc/hosts format. Every line has an IP
+// address followed by one or more names, and # starts a comment.
+func parseHostsFile(path string) (map[string]ZoneConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open hosts file: %w", err)
+	}
+	defer f.Close()
+
+	hosts := make(map[string][]netip.Addr)
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: expected an address followed by names", line)
+		}
+
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid address: %w", line, err)
+		}
+		addr = addr.WithZone("").Unmap()
+
+		for _, name := range fields[1:] {
+			name = newdns.NormalizeDomain(name, true, true, false)
+			if !slices.Contains(hosts[name], addr) {
+				hosts[name] = append(hosts[name], addr)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read hosts file: %w", err)
+	}
+
+	zones := make(map[string]ZoneConfig, len(hosts))
+	for name, addrs := range hosts {
+		zones[name] = ZoneConfig{"": {Addrs: addrs}}
+	}
+	return zones, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// serveHTTP serves the HTTP endpoints on addr until the context is canceled:
+//
+//   - /healthz always reports OK while cname-serve is running.
+//   - /readyz reports OK unless cname-serve is draining.
+//   - /acme/ is served by acme if it is not nil, see [acmeHandler].
+//
+// Only clients within allow may access them.
+func serveHTTP(ctx context.Context, lc *net.ListenConfig, addr string, allow []netip.Prefix, draining *atomic.Bool, acme http.Handler) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok\n")
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		if draining.Load() {
+			http.Error(w, "draining", http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, "ok\n")
+	})
+	if acme != nil {
+		mux.Handle("/acme/", acme)
+	}
+
+	l, err := lc.Listen(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen to HTTP: %w", err)
+	}
+
+	srv := &http.Server{
+		Handler:           allowHTTPHandler(mux, allow),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	if err := srv.Serve(l); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// allowHTTPHandler responds with 403 Forbidden to requests from clients that
+// are not within any of the allowed prefixes.
+func allowHTTPHandler(h http.Handler, allow []netip.Prefix) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+		if err != nil || !prefixesContain(allow, addrPort.Addr().Unmap()) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// tokenAuthorized returns true if the request carries the token either as a
+// bearer token or as the password of basic auth. No request is authorized by
+// an empty token.
+func tokenAuthorized(r *http.Request, token string) bool {
+	if token == "" {
+		return false
+	}
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		_, got, ok = r.BasicAuth()
+	}
+	return ok && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// drainOnSignal toggles draining whenever SIGUSR1 is received until the
+// context is canceled. Queries keep being served while draining.
+func drainOnSignal(ctx context.Context, draining *atomic.Bool) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1)
+	defer signal.Stop(sig)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sig:
+		}
+
+		// There is only one writer, so this does not race.
+		if !draining.Load() {
+			draining.Store(true)
+			slog.Info(
+				"draining, reporting not ready")
+		} else {
+			draining.Store(false)
+			slog.Info(
+				"no longer draining, reporting ready")
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"slices"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// maxTCPIdleTimeout is the longest idle timeout that the edns-tcp-keepalive
+// option can advertise, since it is a 16 bit number of 100ms units.
+const maxTCPIdleTimeout = 0xFFFF * 100 * time.Millisecond
+
+// tcpKeepaliveHandler advertises idle as the idle timeout of TCP connections
+// (RFC 7828) in the responses of h to TCP clients that ask for it with the
+// edns-tcp-keepalive option, so that they know how long they may keep reusing
+// their connection. The option is removed from all other responses, such as
+// forwarded ones, since it must only be sent over TCP.
+func tcpKeepaliveHandler(idle time.Duration, h dns.Handler) dns.Handler {
+	timeout := uint16(idle / (100 * time.Millisecond))
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		opt := req.IsEdns0()
+		if opt == nil {
+			h.ServeDNS(w, req)
+			return
+		}
+
+		advertise := w.RemoteAddr().Network() == "tcp" && slices.ContainsFunc(opt.Option, func(o dns.EDNS0) bool {
+			return o.Option() == dns.EDNS0TCPKEEPALIVE
+		})
+		h.ServeDNS(&keepaliveResponseWriter{
+			ResponseWriter: w,
+			timeout:        timeout,
+			advertise:      advertise,
+		}, req)
+	})
+}
+
+type keepaliveResponseWriter struct {
+	dns.ResponseWriter
+	timeout   uint16
+	advertise bool
+}
+
+func (w *keepaliveResponseWriter) Unwrap() dns.ResponseWriter { return w.ResponseWriter }
+
+func (w *keepaliveResponseWriter) WriteMsg(m *dns.Msg) error {
+	opt := m.IsEdns0()
+	if opt != nil {
+		opt.Option = slices.DeleteFunc(opt.Option, func(o dns.EDNS0) bool {
+			return o.Option() == dns.EDNS0TCPKEEPALIVE
+		})
+	}
+	if w.advertise {
+		if opt == nil {
+			m.SetEdns0(ednsBufferSize, false)
+			opt = m.IsEdns0()
+		}
+		opt.Option = append(opt.Option, &dns.EDNS0_TCP_KEEPALIVE{
+			Code:    dns.EDNS0TCPKEEPALIVE,
+			Timeout: w.timeout,
+		})
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
@@ -2,32 +2,44 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
+	"net/http"
 	"net/netip"
 	"os"
 	"os/signal"
 	"slices"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/256dpi/newdns"
 	"github.com/charmbracelet/log"
 	"github.com/miekg/dns"
 	"github.com/spf13/pflag"
+	"golang.org/x/net/netutil"
 	"golang.org/x/sync/errgroup"
 	"tailscale.com/tsnet"
 )
 
 var (
-	configPath = "config.toml"
-	verbose    = false
+	configPath    = "config.toml"
+	strictConfig  = false
+	verbose       = false
+	listenFDsOnly = false
 )
 
 func init() {
 	pflag.StringVarP(&configPath, "config", "c", configPath, "path to config file")
+	pflag.BoolVar(&strictConfig, "strict-config", strictConfig, "fail on unknown config keys")
 	pflag.BoolVarP(&verbose, "verbose", "v", verbose, "print debug logs")
+	pflag.BoolVar(&listenFDsOnly, "listen-fds-only", listenFDsOnly, "only serve on sockets passed by socket activation, see listen_fds_only")
+	// Leave flags after the command to the command.
+	pflag.CommandLine.SetInterspersed(false)
 }
 
 func main() {
@@ -43,11 +55,25 @@ func main() {
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer cancel()
 
-	os.Exit(run(ctx))
+	switch cmd := pflag.Arg(0); cmd {
+	case "":
+		os.Exit(run(ctx))
+	case "export":
+		os.Exit(runExport(ctx, pflag.Args()[1:]))
+	case "bench":
+		os.Exit(runBench(ctx, pflag.Args()[1:]))
+	case "verify":
+		os.Exit(runVerify(ctx, pflag.Args()[1:]))
+	default:
+		slog.Error(
+			"unknown command",
+			"command", cmd)
+		os.Exit(2)
+	}
 }
 
 func run(ctx context.Context) int {
-	cfg, err := ParseConfigFile(configPath)
+	cfg, err := ParseConfigFile(configPath, strictConfig)
 	if err != nil {
 		slog.Error(
 			"failed to parse config file",
@@ -64,121 +90,247 @@ func run(ctx context.Context) int {
 		return 1
 	}
 
-	zones := make([]newdns.Zone, 0, len(cfg.Zones))
-	for zone, zcfg := range cfg.Zones {
-		zone = newdns.NormalizeDomain(zone, true, true, false)
+	errg, ctx := errgroup.WithContext(ctx)
 
-		slog := slog.With(
-			"zone", zone)
-
-		targets := make(map[string]string, len(zcfg))
-		for name, target := range zcfg {
-			target = newdns.NormalizeDomain(target, true, true, false)
-			targets[name] = target
-
-			slog.Debug(
-				"added target into zone",
-				"name", name,
-				"target", target)
-		}
-
-		zones = append(zones, newdns.Zone{
-			Name:             zone,
-			MasterNameServer: hostname + ".",
-			AllNameServers:   []string{hostname + ".", hostname + "."},
-			Handler: func(name string) ([]newdns.Set, error) {
-				slog := slog.With(
-					"name", name)
-
-				target, ok := targets[name]
-				if !ok {
-					slog.Debug(
-						"no target found for name")
-					return nil, nil
-				}
+	// selfAddrs holds the Tailscale IPs of this node once it is up. It is
+	// served at tailscale.self_name if that is set.
+	var selfAddrs atomic.Pointer[[]netip.Addr]
+
+	zoneOpts := zoneSetOptions{
+		Hostname:    hostname,
+		Resolver:    finalizeResolver(cfg),
+		TargetDrift: newTargetDrift(),
+		SelfAddrs: func() []netip.Addr {
+			if addrs := selfAddrs.Load(); addrs != nil {
+				return *addrs
+			}
+			return nil
+		},
+	}
+	if cfg.Tailscale.Enable {
+		zoneOpts.SelfName = cfg.Tailscale.SelfName
+	}
+	if cfg.FallbackDNS != "" {
+		zoneOpts.FallbackResolver = fallbackResolver(cfg)
+	}
 
-				if cfg.Finalize {
-					targetIPs, err := net.DefaultResolver.LookupIP(ctx, "ip", target)
-					if err != nil {
-						return nil, fmt.Errorf("failed to resolve target: %w", err)
-					}
-
-					slog.Debug(
-						"resolved target to IPs",
-						"target", target,
-						"ips", targetIPs)
-
-					return []newdns.Set{
-						{
-							Name:    joinDomain(name, zone),
-							Type:    newdns.A,
-							Records: ipsToDNSRecords(targetIPs),
-							TTL:     time.Duration(cfg.Expire),
-						},
-					}, nil
-				} else {
-					return []newdns.Set{
-						{
-							Name:    joinDomain(name, zone),
-							Type:    newdns.CNAME,
-							Records: []newdns.Record{{Address: target}},
-							TTL:     time.Duration(cfg.Expire),
-						},
-					}, nil
-				}
-			},
+	if cfg.FinalizeRedis != nil {
+		zoneOpts.SharedCache, err = newRedisCache(ctx, *cfg.FinalizeRedis)
+		if err != nil {
+			slog.Error(
+				"failed to set up redis cache",
+				"err", err)
+			return 1
+		}
+	}
+
+	store, err := newZoneStore(ctx, cfg, zoneOpts)
+	if err != nil {
+		slog.Error(
+			"failed to build zones",
+			"err", err)
+		return 1
+	}
+
+	var acme http.Handler
+	if ref := cfg.ACME.Token; ref != "" {
+		if cfg.HTTPAddr == "" {
+			slog.Error(
+				"acme.token requires http_addr to serve the API on")
+			return 1
+		}
+
+		token := ref
+		if isSecretURI(ref) {
+			v, err := resolveSecret(ctx, ref)
+			if err != nil {
+				slog.Error(
+					"failed to load acme.token",
+					"err", err)
+				return 1
+			}
+			token = strings.TrimSpace(string(v))
+			if token == "" {
+				slog.Error(
+					"acme.token is empty",
+					"secret", ref)
+				return 1
+			}
+		}
+
+		store.acme = newACMERecords()
+		acme = acmeHandler(store, token)
+	}
+
+	if cfg.HostsFile != "" {
+		if err := loadHostsFile(store, cfg.HostsFile); err != nil {
+			slog.Error(
+				"failed to load hosts file",
+				"path", cfg.HostsFile,
+				"err", err)
+			return 1
+		}
+
+		errg.Go(func() error {
+			return watchHostsFile(ctx, store, cfg.HostsFile)
+		})
+	}
+
+	if cfg.Backend.SQLite != nil {
+		if err := loadSQLite(store, *cfg.Backend.SQLite); err != nil {
+			slog.Error(
+				"failed to load SQLite database",
+				"path", cfg.Backend.SQLite.Path,
+				"err", err)
+			return 1
+		}
+
+		errg.Go(func() error {
+			return watchSQLite(ctx, store, *cfg.Backend.SQLite)
 		})
 	}
 
-	if len(zones) == 0 {
+	if len(store.Zones().zones) == 0 && cfg.Backend.Consul == nil && cfg.Backend.SQLite == nil {
 		slog.Error(
 			"no zones configured")
-		os.Exit(1)
+		return 1
 	}
 
-	// create dnsHandler
-	dnsHandler := newdns.NewServer(newdns.Config{
-		Handler: func(name string) (*newdns.Zone, error) {
-			for _, zone := range zones {
-				if newdns.InZone(zone.Name, name) {
-					return &zone, nil
-				}
-			}
-			return nil, nil
-		},
-		Logger: logDNSEvent,
+	errg.Go(func() error {
+		reloadOnSignal(ctx, store, configPath)
+		return nil
 	})
 
-	dnsMux := dns.NewServeMux()
+	if cfg.Backend.Consul != nil {
+		errg.Go(func() error {
+			return watchConsul(ctx, *cfg.Backend.Consul, store)
+		})
+	}
+
+	if cfg.FallbackDNS == tailscaleDNS && !cfg.Tailscale.Enable && !cfg.AuthoritativeOnly {
+		slog.Warn(
+			"fallback_dns is Tailscale's resolver, but Tailscale is disabled; "+
+				"queries for names outside of the zones will time out unless this host is on a Tailnet, "+
+				"set fallback_dns to a reachable resolver such as 1.1.1.1:53",
+			"fallback_dns", cfg.FallbackDNS,
+			"tailscale.enable", cfg.Tailscale.Enable)
+	}
 
 	// Add in fallback if available.
 	var proxyHandler dns.Handler
-	if cfg.FallbackDNS != "" {
-		proxyHandler = newdns.Proxy(cfg.FallbackDNS, logDNSEvent)
-		dnsMux.Handle(".", newdns.Proxy(cfg.FallbackDNS, logDNSEvent))
+	var pool *fallbackPool
+	switch {
+	case cfg.AuthoritativeOnly:
+		slog.Info(
+			"authoritative_only is set, not forwarding any queries",
+			"fallback_dns", cfg.FallbackDNS)
+	case len(cfg.FallbackPool.Servers) > 0:
+		pool = newFallbackPool(cfg)
+		errg.Go(func() error {
+			pool.Run(ctx)
+			return nil
+		})
+		proxyHandler = pool
+	case cfg.FallbackDNS != "":
+		proxyHandler = newProxy(cfg, cfg.FallbackDNS)
 	}
 
-	// Add in all zones.
-	for _, zone := range zones {
-		dnsHandlerWithFallback := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
-			wmock := &mockDNSResponseWriter{ResponseWriter: w}
-			dnsHandler.ServeDNS(wmock, req)
-
-			if wmock.msg.Rcode == dns.RcodeNameError && proxyHandler != nil {
-				// If the request failed, try the fallback.
-				proxyHandler.ServeDNS(w, req)
-			} else {
-				// Otherwise, return the response as-is.
-				w.WriteMsg(wmock.msg)
-			}
+	handler := newZoneHandler(store, proxyHandler)
+	handler = shadowHandler(store, handler)
+	handler = statsTXTHandler(store, handler)
+	handler = rootHandler(store, handler)
+	handler = reverseHandler(store, handler)
+	handler = suppressHandler(store, handler)
+	handler = allowlistHandler(store, handler)
+	handler = allowHandler(store, handler)
+	handler = queryLogHandler(store, handler)
+	// Outside of all policies, so that refused clients can ask why.
+	handler = refusalHandler(store, newRefusalLog(), handler)
+	if cfg.Debug.ResponseDelay > 0 || cfg.Debug.ResponseJitter > 0 {
+		slog.Warn(
+			"DEBUG: artificially delaying all responses, do not use this in production",
+			"delay", time.Duration(cfg.Debug.ResponseDelay),
+			"jitter", time.Duration(cfg.Debug.ResponseJitter))
+		handler = delayHandler(ctx, store, handler,
+			time.Duration(cfg.Debug.ResponseDelay),
+			time.Duration(cfg.Debug.ResponseJitter))
+	}
+	handler = ednsVersionHandler(handler)
+	handler = tcpKeepaliveHandler(time.Duration(cfg.TCPIdleTimeout), handler)
+	if cfg.DnstapSocket != "" {
+		tap := newDnstapWriter(cfg.DnstapSocket)
+		errg.Go(func() error {
+			return tap.run(ctx)
 		})
-		dnsMux.Handle(zone.Name, dnsHandlerWithFallback)
+		handler = dnstapHandler(tap, handler)
 	}
+	// Outermost, so that panics in any of the handlers above are recovered.
+	// Keep it last when adding handlers.
+	handler = recoverHandler(handler)
+
+	// lc is used for all listeners that are not on Tailscale.
+	var lc net.ListenConfig
+	if cfg.BindDevice != "" {
+		if cfg.Tailscale.Enable {
+			slog.Warn(
+				"bind_device does not apply to Tailscale listeners",
+				"device", cfg.BindDevice)
+		}
 
-	errg, ctx := errgroup.WithContext(ctx)
+		control, err := bindDeviceControl(cfg.BindDevice)
+		if err != nil {
+			slog.Error(
+				"failed to set up bind_device",
+				"device", cfg.BindDevice,
+				"err", err)
+			return 1
+		}
+		lc.Control = control
+	}
+
+	// dnsLC is used for the DNS listeners that are not on Tailscale, which
+	// also mark their packets with dscp.
+	dnsLC := lc
+	if cfg.DSCP != 0 {
+		control, err := dscpControl(cfg.DSCP)
+		if err != nil {
+			slog.Error(
+				"failed to set up dscp",
+				"dscp", cfg.DSCP,
+				"err", err)
+			return 1
+		}
+		dnsLC.Control = chainControls(lc.Control, control)
+	}
+
+	// listeners describes where queries are served for the startup summary.
+	var listeners []string
+
+	fdsOnly := listenFDsOnly || cfg.ListenFDsOnly
+	if fdsOnly {
+		if err := checkListenFDsOnly(cfg); err != nil {
+			slog.Error(
+				"config opens its own sockets despite listen_fds_only",
+				"err", err)
+			return 1
+		}
+	}
 
 	if cfg.Tailscale.Enable {
 		authKey := os.Getenv("TS_AUTHKEY")
+		if ref := cfg.Tailscale.AuthKey; ref != "" {
+			authKey = ref
+			if isSecretURI(ref) {
+				v, err := resolveSecret(ctx, ref)
+				if err != nil {
+					slog.Error(
+						"failed to load tailscale.auth_key",
+						"err", err)
+					return 1
+				}
+				authKey = strings.TrimSpace(string(v))
+			}
+		}
 		if authKey == "" {
 			slog.Warn(
 				"Tailscale auth key not set",
@@ -186,17 +338,29 @@ func run(ctx context.Context) int {
 			return 1
 		}
 
-		if cfg.Addr != ":53" {
+		if err := checkTailscaleAddr(cfg.Addr); err != nil {
 			slog.Error(
-				"server must be configured to listen to port 53 when using Tailscale",
-				"want_addr", ":53")
+				"server must be configured to listen to port 53 on all addresses when using Tailscale",
+				"addr", cfg.Addr,
+				"want_addr", ":53",
+				"err", err)
+			return 1
+		}
+
+		authKey, err = tailscaleAuthKey(ctx, authKey, cfg.Tailscale)
+		if err != nil {
+			slog.Error(
+				"failed to get Tailscale auth key",
+				"err", err)
 			return 1
 		}
 
 		tss := tsnet.Server{
-			Dir:       os.Getenv("CONFIGURATION_DIRECTORY"),
-			Ephemeral: cfg.Tailscale.Ephemeral,
-			Hostname:  cfg.Tailscale.Hostname,
+			Dir:        os.Getenv("CONFIGURATION_DIRECTORY"),
+			Ephemeral:  cfg.Tailscale.Ephemeral,
+			Hostname:   cfg.Tailscale.Hostname,
+			AuthKey:    authKey,
+			ControlURL: cfg.Tailscale.ControlURL,
 			UserLogf: func(format string, args ...interface{}) {
 				slog.Info(
 					"Tailscale: "+fmt.Sprintf(format, args...),
@@ -219,22 +383,67 @@ func run(ctx context.Context) int {
 
 		slog.Debug("Tailscale connection up")
 
-		firstV4Ix := slices.IndexFunc(tsStatus.TailscaleIPs, netip.Addr.Is4)
-		if firstV4Ix == -1 {
+		if zoneOpts.SelfName != "" {
+			ips := slices.Clone(tsStatus.TailscaleIPs)
+			selfAddrs.Store(&ips)
+
+			lc, err := tss.LocalClient()
+			if err != nil {
+				slog.Error(
+					"failed to get Tailscale local client",
+					"err", err)
+				return 1
+			}
+
+			errg.Go(func() error {
+				watchTailscaleIPs(ctx, lc, &selfAddrs)
+				return nil
+			})
+		}
+
+		// Prefer IPv4, but allow IPv6-only nodes.
+		listenIPIx := slices.IndexFunc(tsStatus.TailscaleIPs, netip.Addr.Is4)
+		if listenIPIx == -1 {
+			listenIPIx = slices.IndexFunc(tsStatus.TailscaleIPs, netip.Addr.Is6)
+		}
+		if listenIPIx == -1 {
 			slog.Error(
-				"no IPv4 address found in given Tailscale IPs",
+				"no IPv4 or IPv6 address found in given Tailscale IPs",
 				"ips", tsStatus.TailscaleIPs)
 			return 1
 		}
 
-		firstV4 := tsStatus.TailscaleIPs[firstV4Ix]
+		listenIP := tsStatus.TailscaleIPs[listenIPIx]
 		slog.Debug(
-			"using Tailscale's first IPv4 address",
-			"addr", firstV4)
+			"using Tailscale address",
+			"addr", listenIP)
+		listeners = append(listeners, "udp+tcp "+netip.AddrPortFrom(listenIP, 53).String()+" (tailscale)")
+
+		// The Tailscale listeners are only shut down once in-flight queries
+		// completed or the grace period is over.
+		var inFlight atomic.Int64
+		tsHandler := inFlightHandler(&inFlight, handler)
+
+		tsCtx, tsCancel := context.WithCancel(context.Background())
+		defer tsCancel()
+
+		errg.Go(func() error {
+			<-ctx.Done()
+			grace := time.Duration(cfg.Tailscale.ShutdownGrace)
+			if n := inFlight.Load(); n > 0 {
+				slog.Info(
+					"waiting for in-flight queries before closing Tailscale listeners",
+					"in_flight", n,
+					"grace", grace)
+				waitInFlight(&inFlight, grace)
+			}
+			tsCancel()
+			return nil
+		})
 
 		// Start UDP server:
 		errg.Go(func() error {
-			conn, err := tss.ListenPacket("udp", netip.AddrPortFrom(firstV4, 53).String())
+			conn, err := tss.ListenPacket("udp", netip.AddrPortFrom(listenIP, 53).String())
 			if err != nil {
 				return fmt.Errorf("failed to listen to UDP on Tailscale: %w", err)
 			}
@@ -244,11 +453,11 @@ func run(ctx context.Context) int {
 				"conn.local_addr", conn.LocalAddr())
 			slog.Info("UDP DNS server starting via Tailscale")
 
-			dnss := newDNSServer("udp", dnsMux)
+			dnss := newDNSServer(cfg, "udp", tsHandler)
 			dnss.PacketConn = conn
 
 			errg.Go(func() error {
-				ctxWaitShutdown(ctx, dnss)
+				ctxWaitShutdown(tsCtx, dnss)
 				return nil
 			})
 
@@ -257,7 +466,7 @@ func run(ctx context.Context) int {
 
 		// Start TCP server:
 		errg.Go(func() error {
-			conn, err := tss.Listen("tcp", netip.AddrPortFrom(firstV4, 53).String())
+			conn, err := tss.Listen("tcp", netip.AddrPortFrom(listenIP, 53).String())
 			if err != nil {
 				return fmt.Errorf("failed to listen to TCP on Tailscale: %w", err)
 			}
@@ -267,49 +476,218 @@ func run(ctx context.Context) int {
 				"conn.local_addr", conn.Addr())
 			slog.Info("TCP DNS server starting via Tailscale")
 
-			dnss := newDNSServer("tcp", dnsMux)
+			dnss := newDNSServer(cfg, "tcp", tsHandler)
+			dnss.IdleTimeout = tcpIdleTimeout(cfg)
+			if cfg.MaxMessageSize > 0 {
+				dnss.DecorateReader = maxMessageSizeReader(cfg.MaxMessageSize)
+			}
 			dnss.Listener = conn
 
 			errg.Go(func() error {
-				ctxWaitShutdown(ctx, dnss)
+				ctxWaitShutdown(tsCtx, dnss)
 				return nil
 			})
 
 			return dnss.ActivateAndServe()
 		})
+	} else if sockets, err := listenFDs(); err != nil {
+		slog.Error(
+			"failed to use activated sockets",
+			"err", err)
+		return 1
+	} else if !sockets.empty() {
+		slog.Info(
+			"DNS server starting on activated sockets",
+			"udp", len(sockets.packetConns),
+			"tcp", len(sockets.listeners))
+
+		for _, conn := range sockets.packetConns {
+			listeners = append(listeners, "udp "+conn.LocalAddr().String()+" (activated)")
+			errg.Go(func() error {
+				defer closeHandleErr(conn)
+
+				dnss := newDNSServer(cfg, "udp", handler)
+				dnss.PacketConn = conn
+
+				errg.Go(func() error {
+					ctxWaitShutdown(ctx, dnss)
+					return nil
+				})
+
+				return dnss.ActivateAndServe()
+			})
+		}
+
+		for _, l := range sockets.listeners {
+			listeners = append(listeners, "tcp "+l.Addr().String()+" (activated)")
+			errg.Go(func() error {
+				if cfg.MaxTCPConnections > 0 {
+					l = netutil.LimitListener(l, cfg.MaxTCPConnections)
+				}
+
+				dnss := newDNSServer(cfg, "tcp", handler)
+				dnss.IdleTimeout = tcpIdleTimeout(cfg)
+				if cfg.MaxMessageSize > 0 {
+					dnss.DecorateReader = maxMessageSizeReader(cfg.MaxMessageSize)
+				}
+				dnss.Listener = l
+
+				errg.Go(func() error {
+					ctxWaitShutdown(ctx, dnss)
+					return nil
+				})
+
+				return dnss.ActivateAndServe()
+			})
+		}
+	} else if fdsOnly {
+		slog.Error(
+			"no sockets were passed by socket activation, refusing to listen on addr because of listen_fds_only",
+			"addr", cfg.Addr)
+		return 1
 	} else {
 		slog.Info(
 			"DNS server starting",
 			"addr", cfg.Addr)
+		listeners = append(listeners, "udp+tcp "+cfg.Addr)
 
 		// Start UDP server:
 		errg.Go(func() error {
-			dnss := newDNSServer("udp", dnsMux)
-			dnss.Addr = cfg.Addr
+			conn, err := retryBind(ctx, cfg.BindRetries, "udp", cfg.Addr, func() (net.PacketConn, error) {
+				return dnsLC.ListenPacket(ctx, "udp", cfg.Addr)
+			})
+			if err != nil {
+				return fmt.Errorf("failed to listen to UDP: %w", err)
+			}
+			defer closeHandleErr(conn)
+
+			dnss := newDNSServer(cfg, "udp", handler)
+			dnss.PacketConn = conn
 
 			errg.Go(func() error {
 				ctxWaitShutdown(ctx, dnss)
 				return nil
 			})
 
-			return dnss.ListenAndServe()
+			return dnss.ActivateAndServe()
 		})
 
 		// Start TCP server:
 		errg.Go(func() error {
-			dnss := newDNSServer("tcp", dnsMux)
-			dnss.Addr = cfg.Addr
+			l, err := retryBind(ctx, cfg.BindRetries, "tcp", cfg.Addr, func() (net.Listener, error) {
+				return dnsLC.Listen(ctx, "tcp", cfg.Addr)
+			})
+			if err != nil {
+				return fmt.Errorf("failed to listen to TCP: %w", err)
+			}
+
+			if cfg.MaxTCPConnections > 0 {
+				l = netutil.LimitListener(l, cfg.MaxTCPConnections)
+			}
+
+			dnss := newDNSServer(cfg, "tcp", handler)
+			dnss.IdleTimeout = tcpIdleTimeout(cfg)
+			if cfg.MaxMessageSize > 0 {
+				dnss.DecorateReader = maxMessageSizeReader(cfg.MaxMessageSize)
+			}
+			dnss.Listener = l
 
 			errg.Go(func() error {
 				ctxWaitShutdown(ctx, dnss)
 				return nil
 			})
 
-			return dnss.ListenAndServe()
+			return dnss.ActivateAndServe()
 		})
 	}
 
+	if cfg.DoQAddr != "" {
+		tlsConfig, err := cfg.TLS.Load(ctx)
+		if err != nil {
+			slog.Error(
+				"failed to load TLS config for DoQ",
+				"err", err)
+			return 1
+		}
+
+		slog.Info(
+			"DoQ server starting",
+			"addr", cfg.DoQAddr)
+		listeners = append(listeners, "doq "+cfg.DoQAddr)
+
+		errg.Go(func() error {
+			conn, err := retryBind(ctx, cfg.BindRetries, "udp", cfg.DoQAddr, func() (net.PacketConn, error) {
+				return dnsLC.ListenPacket(ctx, "udp", cfg.DoQAddr)
+			})
+			if err != nil {
+				return fmt.Errorf("failed to listen to UDP for DoQ: %w", err)
+			}
+			defer closeHandleErr(conn)
+
+			doqs := newDoQServer(handler)
+			doqs.PaddingBlockSize = cfg.PaddingBlockSize
+			doqs.PadResponses = cfg.PadResponses
+
+			errg.Go(func() error {
+				ctxWaitShutdown(ctx, doqs)
+				return nil
+			})
+
+			return doqs.Serve(conn, tlsConfig)
+		})
+	}
+
+	// draining is toggled by SIGUSR1 and makes /readyz report not ready.
+	var draining atomic.Bool
+	errg.Go(func() error {
+		drainOnSignal(ctx, &draining)
+		return nil
+	})
+
+	if cfg.HTTPAddr != "" {
+		slog.Info(
+			"HTTP server starting",
+			"addr", cfg.HTTPAddr)
+		listeners = append(listeners, "http "+cfg.HTTPAddr)
+
+		errg.Go(func() error {
+			return serveHTTP(ctx, &lc, cfg.HTTPAddr, cfg.HTTPAllow, &draining, acme)
+		})
+	}
+
+	if cfg.Admin.Addr != "" {
+		token, err := cfg.Admin.loadToken(ctx)
+		if err != nil {
+			slog.Error(
+				"failed to load admin.token",
+				"err", err)
+			return 1
+		}
+
+		slog.Info(
+			"admin API starting",
+			"addr", cfg.Admin.Addr)
+		listeners = append(listeners, "admin "+cfg.Admin.Addr)
+
+		admin := adminHandler(store, pool, configPath, token, slices.Clone(listeners))
+		errg.Go(func() error {
+			return serveAdmin(ctx, &lc, cfg.Admin, admin)
+		})
+	}
+
+	logStartupSummary(store.Zones(), listeners)
+
 	if err := errg.Wait(); err != nil {
+		if isBindPermissionError(err) {
+			exe, _ := os.Executable()
+			slog.Error(
+				"not permitted to listen, ports below 1024 require root or the CAP_NET_BIND_SERVICE capability; "+
+					"either run `sudo setcap cap_net_bind_service=+ep "+exe+"`, "+
+					"or run under systemd with AmbientCapabilities=CAP_NET_BIND_SERVICE",
+				"err", err)
+			return 1
+		}
+
 		slog.Error(
 			"failed to run server",
 			"err", err)
@@ -319,6 +697,190 @@ func run(ctx context.Context) int {
 	return 0
 }
 
+// forwardRecursive hands the query to the upstream h, unless it asks for
+// recursion and the client is not in recursion_allow, in which case it is
+// refused.
+func forwardRecursive(cfg *Config, h dns.Handler, w dns.ResponseWriter, req *dns.Msg) {
+	if req.RecursionDesired && len(cfg.RecursionAllow) > 0 && !prefixesContain(cfg.RecursionAllow, clientAddr(w)) {
+		slog.Debug(
+			"refusing to recurse for client",
+			"client", clientAddr(w),
+			"name", req.Question[0].Name)
+		w.WriteMsg(errorResponse(req, dns.RcodeRefused, dns.ExtendedErrorCodeProhibited, "recursion not allowed"))
+		return
+	}
+	h.ServeDNS(w, req)
+}
+
+// newZoneHandler returns a handler that answers queries for the zones in the
+// store. Queries for names that are outside of all zones or that do not exist
+// within their zone are handed to the fallback handler if there is one.
+func newZoneHandler(store *zoneStore, fallback dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		set := store.Zones()
+		q := zoneQuery{qtype: req.Question[0].Qtype, zeroTTL: make(map[string]bool)}
+
+		fallback := fallback
+		if set.cfg.AuthoritativeOnly {
+			// This may have been enabled by a reload.
+			fallback = nil
+		}
+
+		// An outer handler may have started the lookup_timeout already, such
+		// as before delaying the query.
+		ctx := queryContext(w, store.ctx)
+		if timeout := time.Duration(set.cfg.LookupTimeout); timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+			q.deadline, _ = ctx.Deadline()
+		}
+
+		name := newdns.NormalizeDomain(req.Question[0].Name, true, false, false)
+		zone := set.find(name, q)
+		if zone == nil {
+			store.stats.count("")
+			switch {
+			case fallback != nil:
+				forwardRecursive(set.cfg, fallback, w, req)
+			case set.cfg.AuthoritativeOnly:
+				// Like other authoritative servers, refuse names that we are
+				// not authoritative for.
+				w.WriteMsg(errorResponse(req, dns.RcodeRefused, dns.ExtendedErrorCodeNotAuthoritative, ""))
+			default:
+				w.WriteMsg(errorResponse(req, dns.RcodeServerFailure, dns.ExtendedErrorCodeNotAuthoritative, ""))
+			}
+			return
+		}
+		store.stats.count(zone.Name)
+
+		// Some names are answered without newdns, and these are never handed
+		// to the fallback.
+		resp := store.acme.answer(set, req, name)
+		if resp == nil {
+			resp = set.answer(req, name)
+		}
+		if resp == nil {
+			// The zones answer depending on the query, so the server has to
+			// be created for every query. This is cheap.
+			dnsHandler := newdns.NewServer(newdns.Config{
+				Handler: func(name string) (*newdns.Zone, error) {
+					return set.find(name, q), nil
+				},
+				Logger: logDNSEvent,
+			})
+
+			wmock := &mockDNSResponseWriter{ResponseWriter: streamResponseWriter{w}}
+			dnsHandler.ServeDNS(wmock, req)
+
+			if wmock.msg == nil {
+				// The query was ignored.
+				return
+			}
+
+			if wmock.msg.Rcode == dns.RcodeNameError {
+				zone := set.served(name)
+				switch {
+				case zone.unmatchedNoData:
+					// newdns already put the SOA into the authority section.
+					wmock.msg.Rcode = dns.RcodeSuccess
+				case zone.forward != nil:
+					// If the request failed, try the zone's own upstream or
+					// the fallback.
+					forwardRecursive(set.cfg, zone.forward, w, req)
+					return
+				case fallback != nil:
+					forwardRecursive(set.cfg, fallback, w, req)
+					return
+				}
+			}
+
+			resp = wmock.msg
+			clearZeroTTLs(resp, q.zeroTTL)
+			if resp.Rcode == dns.RcodeServerFailure && ctx.Err() != nil {
+				setExtendedError(req, resp, dns.ExtendedErrorCodeNoReachableAuthority, "timed out resolving target")
+			}
+		}
+
+		cfg := set.cfg
+		if cfg.IncludeTargetA {
+			appendTargetAddrs(ctx, set.resolver, w, req, resp)
+		}
+		set.appendExternalTargetAddrs(ctx, w, req, resp)
+		if cfg.MinimalResponses {
+			minimizeResponse(resp)
+		}
+		if len(cfg.MinTTL) > 0 {
+			// Before the negative TTL, which has the last word on how long
+			// negative answers are cached.
+			applyMinTTLs(resp, cfg)
+		}
+		if cfg.NegativeTTL > 0 {
+			setNegativeTTL(resp, time.Duration(cfg.NegativeTTL))
+		}
+		if cfg.Serial != serialFixed {
+			setSerial(resp, set.serial)
+		}
+		orderAnswers(resp, cfg.AnswerOrder, clientAddr(w))
+		truncateResponse(w, req, resp, cfg.Truncation)
+
+		w.WriteMsg(resp)
+	})
+}
+
+// chainControls returns a [net.ListenConfig] Control function that calls both
+// functions in order, either of which may be nil.
+func chainControls(first, second func(network, address string, c syscall.RawConn) error) func(network, address string, c syscall.RawConn) error {
+	if first == nil {
+		return second
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		if err := first(network, address, c); err != nil {
+			return err
+		}
+		return second(network, address, c)
+	}
+}
+
+// isBindPermissionError returns true if err is caused by not being allowed to
+// listen on an address, which is usually a privileged port.
+func isBindPermissionError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "listen" && errors.Is(err, os.ErrPermission)
+}
+
+// retryBind calls listen until it succeeds, retrying up to retries times with
+// an exponential backoff while the address is in use or not available yet,
+// such as while the previous instance is still shutting down.
+func retryBind[T any](ctx context.Context, retries int, network, addr string, listen func() (T, error)) (T, error) {
+	delay := 250 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		l, err := listen()
+		if err == nil || attempt >= retries ||
+			!(errors.Is(err, syscall.EADDRINUSE) || errors.Is(err, syscall.EADDRNOTAVAIL)) {
+			return l, err
+		}
+
+		slog.Warn(
+			"failed to bind, retrying",
+			"network", network,
+			"addr", addr,
+			"attempt", attempt+1,
+			"retries", retries,
+			"retry_in", delay,
+			"err", err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return l, err
+		case <-timer.C:
+		}
+		delay = min(2*delay, 5*time.Second)
+	}
+}
+
 func logDNSEvent(e newdns.Event, msg *dns.Msg, err error, reason string) {
 	slog := slog.With(
 		"event", e.String(),
@@ -334,22 +896,81 @@ func logDNSEvent(e newdns.Event, msg *dns.Msg, err error, reason string) {
 	}
 }
 
-func newDNSServer(network string, mux *dns.ServeMux) *dns.Server {
+// configSummary is an overview of what is served and how.
+type configSummary struct {
+	Zones            int      `json:"zones"`
+	Names            int      `json:"names"`
+	Listen           []string `json:"listen"`
+	Fallback         string   `json:"fallback"`
+	Finalize         bool     `json:"finalize"`
+	FinalizeResolver string   `json:"finalize_resolver"`
+	Tailscale        bool     `json:"tailscale"`
+	Consul           bool     `json:"consul"`
+	SQLite           bool     `json:"sqlite"`
+}
+
+func newConfigSummary(set *zoneSet, listeners []string) configSummary {
+	cfg := set.cfg
+
+	var names int
+	for _, entries := range set.names {
+		names += len(entries)
+	}
+
+	fallback := cfg.FallbackDNS
+	if fallback == "" || cfg.AuthoritativeOnly {
+		fallback = "none"
+	}
+
+	resolver := "system"
+	switch {
+	case cfg.FinalizeResolver != "":
+		resolver = cfg.FinalizeResolver
+	case cfg.FinalizeFallback:
+		resolver = "fallback"
+	}
+
+	return configSummary{
+		Zones:            len(set.zones),
+		Names:            names,
+		Listen:           listeners,
+		Fallback:         fallback,
+		Finalize:         cfg.Finalize,
+		FinalizeResolver: resolver,
+		Tailscale:        cfg.Tailscale.Enable,
+		Consul:           cfg.Backend.Consul != nil,
+		SQLite:           cfg.Backend.SQLite != nil,
+	}
+}
+
+// logStartupSummary logs what is served and how in a single line, so that
+// operators can tell at a glance whether the config was understood.
+func logStartupSummary(set *zoneSet, listeners []string) {
+	summary := newConfigSummary(set, listeners)
+	slog.Info(
+		"startup summary",
+		"zones", summary.Zones,
+		"names", summary.Names,
+		"listen", summary.Listen,
+		"fallback", summary.Fallback,
+		"finalize", summary.Finalize,
+		"finalize_resolver", summary.FinalizeResolver,
+		"tailscale", summary.Tailscale,
+		"consul", summary.Consul,
+		"sqlite", summary.SQLite)
+}
+
+func newDNSServer(cfg *Config, network string, handler dns.Handler) *dns.Server {
 	return &dns.Server{
 		Net:           network,
-		Handler:       mux,
-		MsgAcceptFunc: newdns.Accept(logDNSEvent),
+		Handler:       handler,
+		MsgAcceptFunc: acceptQuery(cfg.MalformedQueries),
 	}
 }
 
-func ipsToDNSRecords(ips []net.IP) []newdns.Record {
-	records := make([]newdns.Record, 0, len(ips))
-	for _, ip := range ips {
-		records = append(records, newdns.Record{
-			Address: ip.String(),
-		})
-	}
-	return records
+// tcpIdleTimeout returns the IdleTimeout of TCP servers for tcp_idle_timeout.
+func tcpIdleTimeout(cfg *Config) func() time.Duration {
+	return func() time.Duration { return time.Duration(cfg.TCPIdleTimeout) }
 }
 
 func joinDomain(name, zone string) string {
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// writeTestConfig writes a config file with the given contents and returns its
+// path.
+func writeTestConfig(t *testing.T, config string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// testConfig parses a config file with the given contents. fallback_dns
+// defaults to "" instead of the system resolver.
+func testConfig(t *testing.T, config string) *Config {
+	t.Helper()
+	cfg, err := ParseConfigFile(writeTestConfig(t, "fallback_dns = \"\"\n"+config), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// newTestStore returns a store of the zones of cfg that resolves targets with
+// resolver.
+func newTestStore(t *testing.T, cfg *Config, resolver ipResolver) *zoneStore {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	store, err := newZoneStore(ctx, cfg, zoneSetOptions{
+		Hostname: "ns.test",
+		Resolver: resolver,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// staticResolver is an ipResolver that resolves the hosts in it to their
+// addresses and fails for all others.
+type staticResolver map[string][]net.IP
+
+func (r staticResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	addrs, ok := r[dns.Fqdn(host)]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	var ips []net.IP
+	for _, ip := range addrs {
+		if (network == "ip4" && ip.To4() == nil) || (network == "ip6" && ip.To4() != nil) {
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return ips, nil
+}
+
+// testResponseWriter is a dns.ResponseWriter that records the written
+// responses.
+type testResponseWriter struct {
+	network string
+	msgs    []*dns.Msg
+}
+
+func (w *testResponseWriter) LocalAddr() net.Addr {
+	return w.addr("127.0.0.1:53")
+}
+
+func (w *testResponseWriter) RemoteAddr() net.Addr {
+	return w.addr("127.0.0.1:12345")
+}
+
+func (w *testResponseWriter) addr(s string) net.Addr {
+	if w.network == "tcp" {
+		addr, _ := net.ResolveTCPAddr("tcp", s)
+		return addr
+	}
+	addr, _ := net.ResolveUDPAddr("udp", s)
+	return addr
+}
+
+func (w *testResponseWriter) WriteMsg(m *dns.Msg) error {
+	// Like the real writers, the response is packed when it is written, which
+	// fails on invalid responses.
+	if _, err := m.Pack(); err != nil {
+		return err
+	}
+	w.msgs = append(w.msgs, m)
+	return nil
+}
+
+func (w *testResponseWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msgs = append(w.msgs, m)
+	return len(b), nil
+}
+
+func (w *testResponseWriter) Close() error        { return nil }
+func (w *testResponseWriter) TsigStatus() error   { return nil }
+func (w *testResponseWriter) TsigTimersOnly(bool) {}
+func (w *testResponseWriter) Hijack()             {}
+
+// exchange hands req to h over UDP and returns the only response.
+func exchange(t *testing.T, h dns.Handler, req *dns.Msg) *dns.Msg {
+	t.Helper()
+	w := &testResponseWriter{network: "udp"}
+	h.ServeDNS(w, req)
+	if len(w.msgs) != 1 {
+		t.Fatalf("got %d responses to %s, want 1", len(w.msgs), questionString(req))
+	}
+	return w.msgs[0]
+}
+
+// query returns the response of h to a query for the name and type.
+func query(t *testing.T, h dns.Handler, name string, qtype uint16) *dns.Msg {
+	t.Helper()
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	return exchange(t, h, req)
+}
+
+func questionString(req *dns.Msg) string {
+	if len(req.Question) == 0 {
+		return "query without question"
+	}
+	q := req.Question[0]
+	return fmt.Sprintf("%s %s", q.Name, dns.TypeToString[q.Qtype])
+}
+
+func TestRecursionAllow(t *testing.T) {
+	cfg := testConfig(t, `
+recursion_allow = ["10.0.0.0/8"]
+
+[zones."a.test"]
+www = { target = "www.example.net", as = "cname" }
+`)
+	store := newTestStore(t, cfg, staticResolver{})
+
+	var forwarded int
+	fallback := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		forwarded++
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		w.WriteMsg(resp)
+	})
+	handler := newZoneHandler(store, fallback)
+
+	// The test client is 127.0.0.1, which is not allowed to recurse.
+	for _, name := range []string{"www.example.net.", "missing.a.test."} {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+
+		resp := exchange(t, handler, req)
+		if resp.Rcode != dns.RcodeRefused {
+			t.Errorf("%s: got rcode %s, want REFUSED", name, dns.RcodeToString[resp.Rcode])
+		}
+
+		req.RecursionDesired = false
+		exchange(t, handler, req)
+	}
+	if forwarded != 2 {
+		t.Errorf("forwarded %d queries, want only the 2 without RD", forwarded)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"log/slog"
+
+	"github.com/256dpi/newdns"
+	"github.com/miekg/dns"
+)
+
+// Values of Config.MalformedQueries.
+const (
+	// malformedIgnore drops queries that are not standard queries or that
+	// don't have exactly one question without answering them.
+	malformedIgnore = "ignore"
+	// malformedFormErr answers queries with other than one question with
+	// FORMERR and queries that are not standard queries with NOTIMP, so that
+	// strict clients don't have to time out.
+	malformedFormErr = "formerr"
+)
+
+// acceptQuery returns the MsgAcceptFunc of the DNS servers for
+// malformed_queries. Responses are always dropped, so that we never answer
+// answers, which could loop between two servers.
+func acceptQuery(mode string) dns.MsgAcceptFunc {
+	accept := newdns.Accept(logDNSEvent)
+	if mode != malformedFormErr {
+		return accept
+	}
+	return func(dh dns.Header) dns.MsgAcceptAction {
+		action := accept(dh)
+		switch {
+		case action != dns.MsgIgnore:
+			return action
+		case dh.Bits&(1<<15) != 0:
+			return dns.MsgIgnore
+		case int(dh.Bits>>11)&0xF != dns.OpcodeQuery:
+			return dns.MsgRejectNotImplemented
+		default:
+			return dns.MsgReject
+		}
+	}
+}
+
+// ednsVersionHandler answers queries with an EDNS version that we don't
+// support, which is every version but 0, with BADVERS and an OPT record of
+// version 0 (RFC 6891, section 6.1.3), so that the client can retry with a
+// version we support. All other queries are handed to h.
+func ednsVersionHandler(h dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		opt := req.IsEdns0()
+		if opt == nil || opt.Version() == 0 {
+			h.ServeDNS(w, req)
+			return
+		}
+
+		slog.Debug(
+			"answering query with unsupported EDNS version",
+			"client", clientAddr(w),
+			"version", opt.Version())
+
+		// The extended rcode is packed into the OPT record, which advertises
+		// version 0.
+		resp := newResponse(req)
+		resp.Rcode = dns.RcodeBadVers
+		w.WriteMsg(resp)
+	})
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestEDNSVersionHandler(t *testing.T) {
+	var handled bool
+	handler := ednsVersionHandler(dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		handled = true
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		w.WriteMsg(resp)
+	}))
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.a.test.", dns.TypeA)
+	req.SetEdns0(1232, false)
+	req.IsEdns0().SetVersion(1)
+
+	resp := exchange(t, handler, req)
+	if handled {
+		t.Error("a query with EDNS version 1 was handed on")
+	}
+
+	// Round trip the response to check the extended rcode on the wire.
+	b, err := resp.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = new(dns.Msg)
+	if err := resp.Unpack(b); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.Rcode != dns.RcodeBadVers {
+		t.Errorf("got rcode %s, want BADVERS", dns.RcodeToString[resp.Rcode])
+	}
+	opt := resp.IsEdns0()
+	if opt == nil {
+		t.Fatal("response has no OPT record")
+	}
+	if opt.Version() != 0 {
+		t.Errorf("got OPT version %d, want 0", opt.Version())
+	}
+	if resp.Id != req.Id || len(resp.Question) != 1 || resp.Question[0] != req.Question[0] {
+		t.Errorf("response %v does not match the query", resp)
+	}
+
+	req.IsEdns0().SetVersion(0)
+	handled = false
+	if resp := exchange(t, handler, req); !handled || resp.Rcode != dns.RcodeSuccess {
+		t.Errorf("a query with EDNS version 0 was not handed on, got %v", resp)
+	}
+}
+
+func TestAcceptQuery(t *testing.T) {
+	const response = 1 << 15
+	notify := uint16(dns.OpcodeNotify) << 11
+
+	tests := []struct {
+		mode   string
+		header dns.Header
+		want   dns.MsgAcceptAction
+	}{
+		{malformedIgnore, dns.Header{Qdcount: 1}, dns.MsgAccept},
+		{malformedIgnore, dns.Header{Qdcount: 2}, dns.MsgIgnore},
+		{malformedIgnore, dns.Header{Bits: notify, Qdcount: 1}, dns.MsgIgnore},
+		{malformedFormErr, dns.Header{Qdcount: 1}, dns.MsgAccept},
+		{malformedFormErr, dns.Header{Qdcount: 2}, dns.MsgReject},
+		{malformedFormErr, dns.Header{Qdcount: 0}, dns.MsgReject},
+		{malformedFormErr, dns.Header{Bits: notify, Qdcount: 1}, dns.MsgRejectNotImplemented},
+		{malformedFormErr, dns.Header{Bits: response, Qdcount: 1}, dns.MsgIgnore},
+	}
+
+	for _, test := range tests {
+		if got := acceptQuery(test.mode)(test.header); got != test.want {
+			t.Errorf("%s: acceptQuery(%+v) = %v, want %v", test.mode, test.header, got, test.want)
+		}
+	}
+}
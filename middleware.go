@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math/rand/v2"
+	"net/netip"
+	"runtime/debug"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/256dpi/newdns"
+	"github.com/miekg/dns"
+)
+
+// delayHandler delays every query by delay plus a random duration of up to
+// jitter before handing it to h. The lookup_timeout of the query starts before
+// the delay, so that the delay and the lookups of the query together take no
+// longer than it. The delay is skipped if it alone would take longer, since
+// the client will have stopped waiting by then. Queries are dropped if ctx is
+// canceled while waiting.
+func delayHandler(ctx context.Context, store *zoneStore, h dns.Handler, delay, jitter time.Duration) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		d := delay
+		if jitter > 0 {
+			d += rand.N(jitter)
+		}
+
+		if timeout := time.Duration(store.Zones().cfg.LookupTimeout); timeout > 0 {
+			if d > timeout {
+				slog.Debug(
+					"not delaying query past lookup_timeout",
+					"delay", d,
+					"lookup_timeout", timeout)
+				h.ServeDNS(w, req)
+				return
+			}
+
+			qctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			w = &contextResponseWriter{ResponseWriter: w, ctx: qctx}
+		}
+
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		h.ServeDNS(w, req)
+	})
+}
+
+// contextResponseWriter carries the context of a query to the handlers that
+// are called with it, see [queryContext].
+type contextResponseWriter struct {
+	dns.ResponseWriter
+	ctx context.Context
+}
+
+// Unwrap returns the wrapped writer for [queryContext].
+func (w *contextResponseWriter) Unwrap() dns.ResponseWriter { return w.ResponseWriter }
+
+// queryContext returns the context that an outer handler attached to the query
+// that w answers, or ctx if there is none. Writers that wrap another writer
+// must have an Unwrap method for it to be found.
+func queryContext(w dns.ResponseWriter, ctx context.Context) context.Context {
+	for {
+		switch rw := w.(type) {
+		case *contextResponseWriter:
+			return rw.ctx
+		case interface{ Unwrap() dns.ResponseWriter }:
+			w = rw.Unwrap()
+		default:
+			return ctx
+		}
+	}
+}
+
+// recoverHandler recovers from panics in h, so that a bad query cannot take
+// down the server. The panic is logged with the query and stack, and the query
+// is answered with SERVFAIL unless h already responded.
+func recoverHandler(h dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		rw := &recordingResponseWriter{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+
+			var question string
+			if len(req.Question) > 0 {
+				question = req.Question[0].String()
+			}
+			slog.Error(
+				"recovered from panic while handling query",
+				"client", clientAddr(w),
+				"question", question,
+				"panic", v,
+				"stack", string(debug.Stack()))
+
+			if !rw.written {
+				w.WriteMsg(errorResponse(req, dns.RcodeServerFailure, dns.ExtendedErrorCodeOther, "internal error"))
+			}
+		}()
+		h.ServeDNS(rw, req)
+	})
+}
+
+// recordingResponseWriter records whether a response was written.
+type recordingResponseWriter struct {
+	dns.ResponseWriter
+	written bool
+}
+
+func (w *recordingResponseWriter) Unwrap() dns.ResponseWriter { return w.ResponseWriter }
+
+func (w *recordingResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.written = true
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+func (w *recordingResponseWriter) Write(b []byte) (int, error) {
+	w.written = true
+	return w.ResponseWriter.Write(b)
+}
+
+// inFlightHandler counts the queries that are being handled by h in n.
+func inFlightHandler(n *atomic.Int64, h dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		n.Add(1)
+		defer n.Add(-1)
+		h.ServeDNS(w, req)
+	})
+}
+
+// waitInFlight waits for up to grace until no queries are counted in n
+// anymore. It returns immediately if there are none.
+func waitInFlight(n *atomic.Int64, grace time.Duration) {
+	deadline := time.Now().Add(grace)
+	for n.Load() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// allowHandler only hands queries from allowed clients to h. Clients must be
+// within the global allow and the allow of the queried zone, if any.
+// Disallowed clients are answered with REFUSED, or not at all if
+// drop_unauthorized is set.
+func allowHandler(store *zoneStore, h dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		set := store.Zones()
+		client := clientAddr(w)
+
+		allowed := len(set.cfg.Allow) == 0 || prefixesContain(set.cfg.Allow, client)
+		if allowed {
+			name := newdns.NormalizeDomain(req.Question[0].Name, true, false, false)
+			if zone := set.served(name); zone != nil && len(zone.allow) > 0 {
+				allowed = prefixesContain(zone.allow, client)
+			}
+		}
+		if allowed {
+			h.ServeDNS(w, req)
+			return
+		}
+
+		slog.Debug(
+			"refusing query from disallowed client",
+			"client", client,
+			"name", req.Question[0].Name,
+			"drop", set.cfg.DropUnauthorized)
+
+		if set.cfg.DropUnauthorized {
+			return
+		}
+
+		w.WriteMsg(errorResponse(req, dns.RcodeRefused, dns.ExtendedErrorCodeProhibited, ""))
+	})
+}
+
+// suppressHandler leaves the records of the suppress_types of the client out
+// of the answer and additional sections of the responses of h, such as AAAA
+// records for clients that misbehave with them. Answers that are left empty
+// become NODATA.
+func suppressHandler(store *zoneStore, h dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		set := store.Zones()
+		if len(set.cfg.SuppressTypes) == 0 {
+			h.ServeDNS(w, req)
+			return
+		}
+
+		types := set.cfg.suppressedTypes(clientAddr(w))
+		if len(types) == 0 {
+			h.ServeDNS(w, req)
+			return
+		}
+
+		h.ServeDNS(&suppressResponseWriter{ResponseWriter: w, set: set, types: types}, req)
+	})
+}
+
+type suppressResponseWriter struct {
+	dns.ResponseWriter
+	set   *zoneSet
+	types []uint16
+}
+
+func (w *suppressResponseWriter) Unwrap() dns.ResponseWriter { return w.ResponseWriter }
+
+func (w *suppressResponseWriter) WriteMsg(m *dns.Msg) error {
+	suppressed := func(rr dns.RR) bool {
+		return slices.Contains(w.types, rr.Header().Rrtype)
+	}
+
+	hadAnswer := len(m.Answer) > 0
+	m.Answer = slices.DeleteFunc(m.Answer, suppressed)
+	m.Extra = slices.DeleteFunc(m.Extra, suppressed)
+
+	if hadAnswer && len(m.Answer) == 0 && m.Rcode == dns.RcodeSuccess && len(m.Question) > 0 {
+		// Add the SOA of the zone like other NODATA answers, so that the
+		// answer can be cached.
+		name := newdns.NormalizeDomain(m.Question[0].Name, true, false, false)
+		if found := w.set.served(name); found != nil {
+			zone := found.Zone
+			if err := zone.Validate(); err == nil {
+				m.Ns = []dns.RR{zoneSOA(zone, w.set.serial)}
+			}
+		}
+	}
+
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// prefixesContain returns true if addr is within any of the prefixes.
+func prefixesContain(prefixes []netip.Prefix, addr netip.Addr) bool {
+	return slices.ContainsFunc(prefixes, func(p netip.Prefix) bool {
+		return p.Contains(addr)
+	})
+}
+
+// clientAddr returns the IP address of the client that sent the query, or the
+// zero address if it cannot be determined.
+func clientAddr(w dns.ResponseWriter) netip.Addr {
+	addrPort, err := netip.ParseAddrPort(w.RemoteAddr().String())
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addrPort.Addr().Unmap()
+}
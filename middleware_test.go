@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestRecoverHandler(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("www.a.test.", dns.TypeA)
+
+	t.Run("not written", func(t *testing.T) {
+		handler := recoverHandler(dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			panic("boom")
+		}))
+
+		resp := exchange(t, handler, req)
+		if resp.Rcode != dns.RcodeServerFailure {
+			t.Errorf("got rcode %s, want SERVFAIL", dns.RcodeToString[resp.Rcode])
+		}
+		if resp.Id != req.Id {
+			t.Errorf("got ID %d, want %d", resp.Id, req.Id)
+		}
+	})
+
+	t.Run("already written", func(t *testing.T) {
+		handler := recoverHandler(dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			resp := new(dns.Msg)
+			resp.SetReply(req)
+			w.WriteMsg(resp)
+			panic("boom")
+		}))
+
+		// exchange fails if there is a second response.
+		resp := exchange(t, handler, req)
+		if resp.Rcode != dns.RcodeSuccess {
+			t.Errorf("got rcode %s, want the response of the handler", dns.RcodeToString[resp.Rcode])
+		}
+	})
+}
+
+func TestDelayHandler(t *testing.T) {
+	store := newTestStore(t, testConfig(t, `
+lookup_timeout = "1s"
+
+[zones."a.test"]
+www = { target = "www.example.net", as = "cname" }
+`), staticResolver{})
+	answer := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		w.WriteMsg(resp)
+	})
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.a.test.", dns.TypeA)
+
+	tests := []struct {
+		name     string
+		canceled bool
+		delay    time.Duration
+		min, max time.Duration
+		answered bool
+	}{
+		{"delayed", false, 50 * time.Millisecond, 50 * time.Millisecond, time.Second, true},
+		{"past lookup_timeout", false, time.Hour, 0, time.Second, true},
+		{"canceled", true, 50 * time.Millisecond, 0, time.Second, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if test.canceled {
+				cancel()
+			}
+
+			w := &testResponseWriter{network: "udp"}
+			start := time.Now()
+			delayHandler(ctx, store, answer, test.delay, 0).ServeDNS(w, req)
+			took := time.Since(start)
+
+			if took < test.min || took > test.max {
+				t.Errorf("took %v, want between %v and %v", took, test.min, test.max)
+			}
+			if answered := len(w.msgs) > 0; answered != test.answered {
+				t.Errorf("answered = %v, want %v", answered, test.answered)
+			}
+		})
+	}
+}
+
+func TestDelayHandlerDeadline(t *testing.T) {
+	store := newTestStore(t, testConfig(t, `
+lookup_timeout = "1s"
+
+[zones."a.test"]
+www = { target = "www.example.net", as = "cname" }
+`), staticResolver{})
+
+	var deadline time.Time
+	probe := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		deadline, _ = queryContext(w, context.Background()).Deadline()
+	})
+	// The deadline is found through the writers of the handlers in between.
+	handler := delayHandler(context.Background(), store, refusalHandler(store, newRefusalLog(), probe), 200*time.Millisecond, 0)
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.a.test.", dns.TypeA)
+
+	start := time.Now()
+	handler.ServeDNS(&testResponseWriter{network: "udp"}, req)
+
+	if deadline.IsZero() {
+		t.Fatal("the query has no deadline")
+	}
+	if d := deadline.Sub(start); d < 900*time.Millisecond || d > 1100*time.Millisecond {
+		t.Errorf("got deadline %v after the query, want the lookup_timeout from before the delay", d)
+	}
+}
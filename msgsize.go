@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var errMessageTooLarge = errors.New("message exceeds max_message_size")
+
+// maxMessageSizeReader returns a hook for dns.Server.DecorateReader that closes
+// TCP connections whose next message is declared to be larger than limit
+// bytes, before the message is read.
+func maxMessageSizeReader(limit int) dns.DecorateReader {
+	return func(r dns.Reader) dns.Reader {
+		return maxSizeReader{Reader: r, max: limit}
+	}
+}
+
+type maxSizeReader struct {
+	dns.Reader
+	max int
+}
+
+func (r maxSizeReader) ReadTCP(conn net.Conn, timeout time.Duration) ([]byte, error) {
+	b, err := r.Reader.ReadTCP(&maxSizeConn{Conn: conn, max: r.max}, timeout)
+	if errors.Is(err, errMessageTooLarge) {
+		slog.Warn(
+			"closing TCP connection with oversized message",
+			"client", conn.RemoteAddr(),
+			"max_message_size", r.max)
+	}
+	return b, err
+}
+
+// maxSizeConn reads a single length-prefixed message from a TCP connection
+// and fails once the length prefix is larger than max.
+type maxSizeConn struct {
+	net.Conn
+	max    int
+	prefix [2]byte
+	read   int
+}
+
+func (c *maxSizeConn) Read(p []byte) (int, error) {
+	if c.read < len(c.prefix) {
+		n, err := c.Conn.Read(p[:min(len(p), len(c.prefix)-c.read)])
+		copy(c.prefix[c.read:], p[:n])
+		c.read += n
+		return n, err
+	}
+	// The length is only known once the prefix was read, and readers may
+	// ignore errors that come with its last byte, so fail reading the body.
+	if int(binary.BigEndian.Uint16(c.prefix[:])) > c.max {
+		return 0, errMessageTooLarge
+	}
+	return c.Conn.Read(p)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/256dpi/newdns"
+	"github.com/miekg/dns"
+)
+
+// newProxy returns a handler that forwards queries to the DNS server at addr
+// like newdns.Proxy, see [forward]. Queries are sent from fallback_source_addr
+// if it is set, and are answered with SERVFAIL if the upstream fails or while
+// the circuit breaker is open.
+func newProxy(cfg *Config, addr string) dns.Handler {
+	breaker := newCircuitBreaker(addr, cfg.FallbackBreaker)
+
+	client := new(dns.Client)
+	if cfg.FallbackSource.IsValid() {
+		client.Dialer = &net.Dialer{
+			LocalAddr: net.UDPAddrFromAddrPort(netip.AddrPortFrom(cfg.FallbackSource, 0)),
+		}
+	}
+
+	// The warning at startup is easy to miss, so remind about it whenever
+	// forwarding fails, but not for every query.
+	var lastHint atomic.Int64
+	hintUnreachable := func(err error) {
+		if addr != tailscaleDNS || cfg.Tailscale.Enable {
+			return
+		}
+		now := time.Now().UnixNano()
+		last := lastHint.Load()
+		if now-last < int64(time.Minute) || !lastHint.CompareAndSwap(last, now) {
+			return
+		}
+		slog.Warn(
+			"failed to forward to Tailscale's resolver while Tailscale is disabled, "+
+				"set fallback_dns to a reachable resolver",
+			"upstream", addr,
+			"err", err)
+	}
+
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		if !breaker.Allow() {
+			w.WriteMsg(errorResponse(req, dns.RcodeServerFailure,
+				dns.ExtendedErrorCodeNoReachableAuthority, "upstream is failing"))
+			return
+		}
+
+		logDNSEvent(newdns.ProxyRequest, req, nil, "")
+
+		resp, err := forward(client, req, addr, cfg.Use0x20)
+		breaker.Done(err)
+		if err != nil {
+			logDNSEvent(newdns.ProxyError, nil, err, "")
+			hintUnreachable(err)
+
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				w.WriteMsg(errorResponse(req, dns.RcodeServerFailure,
+					dns.ExtendedErrorCodeNoReachableAuthority, "upstream timed out"))
+			} else {
+				w.WriteMsg(errorResponse(req, dns.RcodeServerFailure,
+					dns.ExtendedErrorCodeNetworkError, "upstream failed"))
+			}
+			return
+		}
+
+		logDNSEvent(newdns.ProxyResponse, resp, nil, "")
+
+		if err := w.WriteMsg(resp); err != nil {
+			logDNSEvent(newdns.NetworkError, nil, err, "")
+			w.Close()
+		}
+	})
+}
+
+// forward sends the query to addr under a new random ID instead of the
+// client's, so that off-path attackers cannot guess it, and checks that the
+// response answers the same question. Every query is sent from a new socket,
+// so its source port is randomized by the kernel.
+func forward(client *dns.Client, req *dns.Msg, addr string, use0x20 bool) (*dns.Msg, error) {
+	fwd := req.Copy()
+	fwd.Id = dns.Id()
+	if use0x20 {
+		for i := range fwd.Question {
+			fwd.Question[i].Name = randomizeCase(fwd.Question[i].Name)
+		}
+	}
+
+	resp, _, err := client.Exchange(fwd, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.Question) != len(fwd.Question) {
+		return nil, errors.New("response has a different question")
+	}
+	for i, q := range resp.Question {
+		fq := fwd.Question[i]
+		if q.Qtype != fq.Qtype || q.Qclass != fq.Qclass || !strings.EqualFold(q.Name, fq.Name) {
+			return nil, fmt.Errorf("response is for %s %s instead of the question", q.Name, dns.TypeToString[q.Qtype])
+		}
+		if use0x20 && q.Name != fq.Name {
+			// Spoofed responses are unlikely to guess the case.
+			return nil, fmt.Errorf("response is for %s instead of %s, which differs in case", q.Name, fq.Name)
+		}
+	}
+
+	if use0x20 {
+		// Give the client back the names that it asked for, including the
+		// owner names within them, such as of the SOA of NXDOMAIN answers.
+		for i := range resp.Question {
+			name := req.Question[i].Name
+			resp.Question[i].Name = name
+			for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+				for _, rr := range section {
+					restoreCase(rr.Header(), name)
+				}
+			}
+		}
+	}
+
+	resp.Id = req.Id
+	return resp, nil
+}
+
+// restoreCase sets the owner name of hdr to the case of name if it is name or
+// one of its parents regardless of case.
+func restoreCase(hdr *dns.RR_Header, name string) {
+	n := len(hdr.Name)
+	if n > len(name) {
+		return
+	}
+	suffix := name[len(name)-n:]
+	if strings.EqualFold(hdr.Name, suffix) && (n == len(name) || name[len(name)-n-1] == '.') {
+		hdr.Name = suffix
+	}
+}
+
+// randomizeCase randomly changes the case of every letter of the name, which is
+// known as DNS 0x20 encoding.
+func randomizeCase(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if ('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z') && rand.N(2) == 0 {
+			b[i] ^= 0x20
+		}
+	}
+	return string(b)
+}
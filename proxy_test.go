@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// startTestUpstream serves h on a UDP port of localhost and returns its
+// address.
+func startTestUpstream(t *testing.T, h dns.Handler) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: h}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func TestForward0x20(t *testing.T) {
+	// The upstream answers with the names in the case of the query, like
+	// most servers do through name compression.
+	addr := startTestUpstream(t, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		name := req.Question[0].Name
+		zone := name[strings.Index(name, ".")+1:]
+
+		resp := new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeNameError)
+		resp.Ns = []dns.RR{&dns.SOA{
+			Hdr:    dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60},
+			Ns:     "ns.example.net.",
+			Mbox:   "hostmaster.example.net.",
+			Serial: 1,
+		}}
+		w.WriteMsg(resp)
+	}))
+
+	req := new(dns.Msg)
+	req.SetQuestion("missing.example.com.", dns.TypeA)
+
+	// The case may happen to stay the same, so try a few times.
+	for range 10 {
+		resp, err := forward(new(dns.Client), req, addr, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name := resp.Question[0].Name; name != "missing.example.com." {
+			t.Fatalf("got question %s, want missing.example.com.", name)
+		}
+		if len(resp.Ns) != 1 || resp.Ns[0].Header().Name != "example.com." {
+			t.Fatalf("got authority %v, want the SOA of example.com.", resp.Ns)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/256dpi/newdns"
+	"github.com/miekg/dns"
+)
+
+// queryLogHandler logs every query for the zones with query_log set together
+// with its response at the info level, so that a single zone can be debugged
+// without the debug logs of all others. Queries for other names are handed to
+// h as they are.
+func queryLogHandler(store *zoneStore, h dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		set := store.Zones()
+		name := newdns.NormalizeDomain(req.Question[0].Name, true, false, false)
+		zone := set.served(name)
+		if zone == nil || !zone.queryLog {
+			h.ServeDNS(w, req)
+			return
+		}
+
+		start := time.Now()
+		lw := &queryLogResponseWriter{ResponseWriter: w}
+		h.ServeDNS(lw, req)
+
+		slog := slog.With(
+			"zone", zone.Name,
+			"client", clientAddr(w),
+			"name", req.Question[0].Name,
+			"qtype", dns.TypeToString[req.Question[0].Qtype],
+			"duration", time.Since(start))
+
+		if lw.msg == nil {
+			slog.Info(
+				"query was not answered")
+			return
+		}
+
+		answers := make([]string, len(lw.msg.Answer))
+		for i, rr := range lw.msg.Answer {
+			answers[i] = rr.String()
+		}
+		slog.Info(
+			"answered query",
+			"rcode", dns.RcodeToString[lw.msg.Rcode],
+			"answers", answers)
+	})
+}
+
+// queryLogResponseWriter remembers the response that was written for the
+// query log.
+type queryLogResponseWriter struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (w *queryLogResponseWriter) Unwrap() dns.ResponseWriter { return w.ResponseWriter }
+
+func (w *queryLogResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return w.ResponseWriter.WriteMsg(m)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// redisTimeout is the longest that a lookup waits for Redis before the
+	// target is resolved without it.
+	redisTimeout = time.Second
+	// redisRetryDelay is how long Redis is skipped after it failed.
+	redisRetryDelay = 5 * time.Second
+)
+
+// RedisConfig configures a Redis server that the resolved addresses of targets
+// are shared through, so that replicas don't all resolve the same targets.
+type RedisConfig struct {
+	Addr     string `toml:"addr"`
+	Username string `toml:"username"`
+	// Password may also be a secret reference, see [resolveSecret].
+	Password string `toml:"password"`
+	DB       int    `toml:"db"`
+	// TLS connects to Redis over TLS.
+	TLS bool `toml:"tls"`
+	// KeyPrefix is prepended to all keys. It defaults to "cname-serve:".
+	KeyPrefix string `toml:"key_prefix"`
+}
+
+// redisCache stores the resolved addresses of targets in Redis. While Redis is
+// unreachable, it fails immediately so that lookups don't wait for it.
+type redisCache struct {
+	cfg    RedisConfig
+	client *redis.Client
+
+	mu        sync.Mutex
+	downUntil time.Time
+}
+
+var errRedisDown = errors.New("redis is unreachable, retrying later")
+
+// redisEntry is the value of a target in Redis.
+type redisEntry struct {
+	Addrs   []net.IP  `json:"addrs"`
+	Expires time.Time `json:"expires"`
+}
+
+// newRedisCache creates a cache for the given config. Connections are only
+// dialed when needed.
+func newRedisCache(ctx context.Context, cfg RedisConfig) (*redisCache, error) {
+	if cfg.Addr == "" {
+		return nil, fmt.Errorf("redis addr is not set")
+	}
+	if cfg.KeyPrefix == "" {
+		cfg.KeyPrefix = "cname-serve:"
+	}
+
+	password := cfg.Password
+	if isSecretURI(password) {
+		v, err := resolveSecret(ctx, password)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get redis password: %w", err)
+		}
+		password = strings.TrimSpace(string(v))
+	}
+
+	opts := &redis.Options{
+		Addr:     cfg.Addr,
+		Username: cfg.Username,
+		Password: password,
+		DB:       cfg.DB,
+		// Lookups rather resolve the target themselves than wait for Redis.
+		DialTimeout:           redisTimeout,
+		ReadTimeout:           redisTimeout,
+		WriteTimeout:          redisTimeout,
+		ContextTimeoutEnabled: true,
+		MaxRetries:            -1,
+	}
+	if cfg.TLS {
+		host, _, _ := net.SplitHostPort(cfg.Addr)
+		opts.TLSConfig = &tls.Config{ServerName: host}
+	}
+
+	return &redisCache{cfg: cfg, client: redis.NewClient(opts)}, nil
+}
+
+func (c *redisCache) key(key resolveCacheKey) string {
+	return c.cfg.KeyPrefix + key.network + ":" + key.target
+}
+
+// get returns the addresses of the target and when they expire, or no
+// addresses if Redis has none.
+func (c *redisCache) get(ctx context.Context, key resolveCacheKey) ([]net.IP, time.Time, error) {
+	if err := c.check(); err != nil {
+		return nil, time.Time{}, err
+	}
+
+	rctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+
+	value, err := c.client.Get(rctx, c.key(key)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, time.Time{}, nil
+	}
+	if err != nil {
+		return nil, time.Time{}, c.failed(ctx, err)
+	}
+
+	entry, err := decodeRedisEntry(value)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return entry.Addrs, entry.Expires, nil
+}
+
+// set stores the addresses of the target in Redis until they expire.
+func (c *redisCache) set(ctx context.Context, key resolveCacheKey, ips []net.IP, expires time.Time) error {
+	ttl := time.Until(expires)
+	if ttl < time.Millisecond || len(ips) == 0 {
+		return nil
+	}
+	if err := c.check(); err != nil {
+		return err
+	}
+
+	value, err := encodeRedisEntry(redisEntry{Addrs: ips, Expires: expires})
+	if err != nil {
+		return err
+	}
+
+	rctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+
+	if err := c.client.Set(rctx, c.key(key), value, ttl).Err(); err != nil {
+		return c.failed(ctx, err)
+	}
+	return nil
+}
+
+// check returns errRedisDown if Redis recently failed.
+func (c *redisCache) check() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Now().Before(c.downUntil) {
+		return errRedisDown
+	}
+	return nil
+}
+
+// failed skips Redis for a while if err means that it is unreachable and
+// returns err. ctx is the context of the lookup.
+func (c *redisCache) failed(ctx context.Context, err error) error {
+	// Errors of single commands mean that Redis is up, and the lookup may
+	// have been given up on without Redis being slow.
+	var rerr redis.Error
+	if errors.As(err, &rerr) || ctx.Err() != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Now().Before(c.downUntil) {
+		return err
+	}
+	c.downUntil = time.Now().Add(redisRetryDelay)
+
+	slog.Warn(
+		"redis failed, resolving targets without it",
+		"addr", c.cfg.Addr,
+		"retry_in", redisRetryDelay,
+		"err", err)
+	return err
+}
+
+func encodeRedisEntry(entry redisEntry) ([]byte, error) {
+	return json.Marshal(entry)
+}
+
+func decodeRedisEntry(value []byte) (redisEntry, error) {
+	var entry redisEntry
+	if err := json.Unmarshal(value, &entry); err != nil {
+		return redisEntry{}, fmt.Errorf("invalid value %q: %w", value, err)
+	}
+	if len(entry.Addrs) == 0 || entry.Expires.IsZero() {
+		return redisEntry{}, fmt.Errorf("invalid value %q", value)
+	}
+	return entry, nil
+}
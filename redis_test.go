@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestRedisEntry(t *testing.T) {
+	entry := redisEntry{
+		Addrs:   []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")},
+		Expires: time.UnixMilli(1700000000123),
+	}
+
+	value, err := encodeRedisEntry(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const want = `{"addrs":["192.0.2.1","2001:db8::1"],"expires":"`
+	if got := string(value); len(got) < len(want) || got[:len(want)] != want {
+		t.Errorf("got value %s, want it to start with %s", got, want)
+	}
+
+	got, err := decodeRedisEntry(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Expires.Equal(entry.Expires) {
+		t.Errorf("got expiry %v, want %v", got.Expires, entry.Expires)
+	}
+	if !slices.EqualFunc(got.Addrs, entry.Addrs, net.IP.Equal) {
+		t.Errorf("got addresses %v, want %v", got.Addrs, entry.Addrs)
+	}
+}
+
+func TestDecodeRedisEntryInvalid(t *testing.T) {
+	for _, value := range []string{
+		``,
+		`1700000000123 192.0.2.1`,
+		`{"addrs":[],"expires":"2023-11-14T22:13:20Z"}`,
+		`{"addrs":["192.0.2.1"]}`,
+		`{"addrs":["not an ip"],"expires":"2023-11-14T22:13:20Z"}`,
+	} {
+		if entry, err := decodeRedisEntry([]byte(value)); err == nil {
+			t.Errorf("decoding %q succeeded with %+v", value, entry)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/256dpi/newdns"
+	"github.com/miekg/dns"
+)
+
+const (
+	// refusalQueryPrefix is the label that is put in front of a name to ask
+	// why it was refused.
+	refusalQueryPrefix = "_why."
+	// refusalMaxEntries is how many refusals are remembered at most.
+	refusalMaxEntries = 4096
+)
+
+// refusalLog remembers the last refusal of every client and name, so that
+// operators can ask why a name was refused from the client itself.
+type refusalLog struct {
+	mu       sync.Mutex
+	refusals map[refusalKey]refusal
+}
+
+type refusalKey struct {
+	client netip.Addr
+	name   string
+}
+
+type refusal struct {
+	reason string
+	at     time.Time
+}
+
+func newRefusalLog() *refusalLog {
+	return &refusalLog{refusals: make(map[refusalKey]refusal)}
+}
+
+func (l *refusalLog) record(key refusalKey, reason string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.refusals[key]; !ok && len(l.refusals) >= refusalMaxEntries {
+		// Forget an arbitrary refusal, since only recent ones are of
+		// interest anyway.
+		for k := range l.refusals {
+			delete(l.refusals, k)
+			break
+		}
+	}
+	l.refusals[key] = refusal{reason: reason, at: time.Now()}
+}
+
+func (l *refusalLog) lookup(key refusalKey) (refusal, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	r, ok := l.refusals[key]
+	return r, ok
+}
+
+// refusalHandler remembers why the responses of h refused or blocked a name,
+// and answers TXT queries for "_why.<name>" with the last reason for that name
+// and client. It does nothing unless debug.refusal_reasons is set, since the
+// reasons tell clients about the policies.
+func refusalHandler(store *zoneStore, log *refusalLog, h dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		set := store.Zones()
+		if !set.cfg.Debug.RefusalReasons {
+			h.ServeDNS(w, req)
+			return
+		}
+
+		client := clientAddr(w)
+		name := newdns.NormalizeDomain(req.Question[0].Name, true, true, false)
+
+		if refused, ok := strings.CutPrefix(name, refusalQueryPrefix); ok && refused != "" {
+			w.WriteMsg(log.answer(req, refusalKey{client, refused}))
+			return
+		}
+
+		h.ServeDNS(&refusalResponseWriter{
+			ResponseWriter: w,
+			log:            log,
+			key:            refusalKey{client, name},
+		}, req)
+	})
+}
+
+// answer returns the response to a "_why." query for the refusal of key.
+func (l *refusalLog) answer(req *dns.Msg, key refusalKey) *dns.Msg {
+	resp := newResponse(req)
+
+	qtype := req.Question[0].Qtype
+	if qtype != dns.TypeTXT && qtype != dns.TypeANY {
+		return resp
+	}
+
+	text := "no refusal recorded for " + key.name
+	if r, ok := l.lookup(key); ok {
+		text = fmt.Sprintf("%s %s ago", r.reason, time.Since(r.at).Round(time.Second))
+	}
+
+	resp.Answer = []dns.RR{&dns.TXT{
+		// The reason may change with every query, so it is never cached.
+		Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+		Txt: txtRecords([]string{text})[0].Data,
+	}}
+	return resp
+}
+
+type refusalResponseWriter struct {
+	dns.ResponseWriter
+	log *refusalLog
+	key refusalKey
+}
+
+func (w *refusalResponseWriter) Unwrap() dns.ResponseWriter { return w.ResponseWriter }
+
+func (w *refusalResponseWriter) WriteMsg(m *dns.Msg) error {
+	if reason := refusalReason(m); reason != "" {
+		slog.Debug(
+			"recording refusal",
+			"client", w.key.client,
+			"name", w.key.name,
+			"reason", reason)
+		w.log.record(w.key, reason)
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// refusalReason describes why m refused or blocked its question, or returns ""
+// if it didn't. The Extended DNS Error of m is included if it has one, which
+// is only the case if the client supports EDNS.
+func refusalReason(m *dns.Msg) string {
+	var ede *dns.EDNS0_EDE
+	if opt := m.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if e, ok := o.(*dns.EDNS0_EDE); ok {
+				ede = e
+				break
+			}
+		}
+	}
+
+	blocked := ede != nil && (ede.InfoCode == dns.ExtendedErrorCodeBlocked ||
+		ede.InfoCode == dns.ExtendedErrorCodeProhibited)
+	if m.Rcode != dns.RcodeRefused && !blocked {
+		return ""
+	}
+
+	reason := dns.RcodeToString[m.Rcode]
+	if ede != nil {
+		reason += " (" + dns.ExtendedErrorCodeToString[ede.InfoCode]
+		if ede.ExtraText != "" {
+			reason += ": " + ede.ExtraText
+		}
+		reason += ")"
+	}
+	return reason
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// resolvConfPath is the resolver config of the system.
+const resolvConfPath = "/etc/resolv.conf"
+
+// defaultFallbackDNS returns the fallback_dns to use if it is not set. The
+// Tailscale resolver is only used if Tailscale is enabled, since it is
+// unreachable from other hosts. Otherwise, the first nameserver of the system
+// is used, or the Tailscale resolver if the system has none.
+func defaultFallbackDNS(cfg *Config) string {
+	if cfg.Tailscale.Enable {
+		return tailscaleDNS
+	}
+
+	addr, err := systemNameserver(resolvConfPath, cfg.Addr)
+	if err != nil {
+		slog.Warn(
+			"failed to find the system's resolver for fallback_dns, using Tailscale's",
+			"path", resolvConfPath,
+			"fallback_dns", tailscaleDNS,
+			"err", err)
+		return tailscaleDNS
+	}
+
+	slog.Info(
+		"fallback_dns is not set, using the system's resolver",
+		"path", resolvConfPath,
+		"fallback_dns", addr)
+	return addr
+}
+
+// systemNameserver returns the address of the first nameserver in the
+// resolv.conf file at path. Loopback nameservers are skipped if listenAddr is
+// on the same port, since that is likely this server itself and would make
+// queries loop.
+func systemNameserver(path, listenAddr string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	_, listenPort, _ := net.SplitHostPort(listenAddr)
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+
+		addr, err := netip.ParseAddr(fields[1])
+		if err != nil {
+			continue
+		}
+		if addr.IsLoopback() && listenPort == "53" {
+			continue
+		}
+
+		return net.JoinHostPort(addr.String(), "53"), nil
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	return "", fmt.Errorf("no usable nameserver")
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// finalizeResolver returns the resolver of targets that is configured by
+// finalize_resolver or finalize_via_fallback, or nil to use the system
+// resolver.
+func finalizeResolver(cfg *Config) ipResolver {
+	switch {
+	case cfg.FinalizeResolver != "":
+		return newDNSResolver(cfg.FinalizeResolver, cfg.FinalizeConns)
+	case cfg.FinalizeFallback && cfg.FallbackDNS != "":
+		return fallbackResolver(cfg)
+	default:
+		return nil
+	}
+}
+
+// fallbackResolver returns a resolver that queries fallback_dns like the proxy
+// does, including from its source address.
+func fallbackResolver(cfg *Config) *dnsResolver {
+	r := newDNSResolver(cfg.FallbackDNS, cfg.FinalizeConns)
+	if cfg.FallbackSource.IsValid() {
+		r.client.Dialer = &net.Dialer{
+			LocalAddr: net.UDPAddrFromAddrPort(netip.AddrPortFrom(cfg.FallbackSource, 0)),
+		}
+	}
+	return r
+}
+
+// dnsResolver is an ipResolver that queries a single DNS server over a pool of
+// persistent connections instead of dialing for every lookup. It is safe for
+// concurrent use.
+type dnsResolver struct {
+	addr   string
+	client *dns.Client
+
+	// conns limits the number of connections that are in use at once.
+	conns chan struct{}
+
+	mu   sync.Mutex
+	idle []*dns.Conn
+}
+
+// newDNSResolver creates a resolver that queries the DNS server at addr using
+// up to maxConns connections at once.
+func newDNSResolver(addr string, maxConns int) *dnsResolver {
+	return &dnsResolver{
+		addr:   addr,
+		client: new(dns.Client),
+		conns:  make(chan struct{}, max(maxConns, 1)),
+	}
+}
+
+// LookupIP implements ipResolver.
+func (r *dnsResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	var qtypes []uint16
+	switch network {
+	case "ip":
+		qtypes = []uint16{dns.TypeA, dns.TypeAAAA}
+	case "ip4":
+		qtypes = []uint16{dns.TypeA}
+	case "ip6":
+		qtypes = []uint16{dns.TypeAAAA}
+	default:
+		return nil, fmt.Errorf("unsupported network %q", network)
+	}
+
+	var ips []net.IP
+	for _, qtype := range qtypes {
+		resp, err := r.exchange(ctx, dns.Fqdn(host), qtype)
+		if err != nil {
+			return nil, &net.DNSError{Err: err.Error(), Name: host, Server: r.addr}
+		}
+
+		switch resp.Rcode {
+		case dns.RcodeSuccess:
+		case dns.RcodeNameError:
+			return nil, &net.DNSError{Err: "no such host", Name: host, Server: r.addr, IsNotFound: true}
+		default:
+			return nil, &net.DNSError{Err: "server responded with " + dns.RcodeToString[resp.Rcode], Name: host, Server: r.addr}
+		}
+
+		// The answer may contain the CNAME chain to the addresses.
+		for _, rr := range resp.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				ips = append(ips, rr.A)
+			case *dns.AAAA:
+				ips = append(ips, rr.AAAA)
+			}
+		}
+	}
+
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, Server: r.addr, IsNotFound: true}
+	}
+	return ips, nil
+}
+
+func (r *dnsResolver) exchange(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	select {
+	case r.conns <- struct{}{}:
+		defer func() { <-r.conns }()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	conn, err := r.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+
+	resp, _, err := r.client.ExchangeWithConnContext(ctx, req, conn)
+	if err != nil {
+		// Don't reuse the connection, since a late response to this query
+		// could be read as the response to the next one.
+		conn.Close()
+		return nil, err
+	}
+
+	r.mu.Lock()
+	r.idle = append(r.idle, conn)
+	r.mu.Unlock()
+
+	return resp, nil
+}
+
+// conn returns an idle connection or dials a new one.
+func (r *dnsResolver) conn(ctx context.Context) (*dns.Conn, error) {
+	r.mu.Lock()
+	if n := len(r.idle); n > 0 {
+		conn := r.idle[n-1]
+		r.idle = r.idle[:n-1]
+		r.mu.Unlock()
+		return conn, nil
+	}
+	r.mu.Unlock()
+
+	return r.client.DialContext(ctx, r.addr)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const reverseRefreshInterval = time.Minute
+
+// tailscaleRange is the CGNAT range that Tailscale assigns IPv4 addresses from.
+var tailscaleRange = netip.MustParsePrefix("100.64.0.0/10")
+
+// reverseMapper maps Tailscale addresses back to the names within the zones
+// that point to them, so that PTR queries for them can be answered.
+type reverseMapper struct {
+	resolver ipResolver
+	names    map[string]*nameEntry // FQDN -> entry
+	addrs    atomic.Pointer[map[netip.Addr][]string]
+}
+
+func newReverseMapper(resolver ipResolver) *reverseMapper {
+	return &reverseMapper{
+		resolver: resolver,
+		names:    make(map[string]*nameEntry),
+	}
+}
+
+// Add adds the name to the mapper.
+func (m *reverseMapper) Add(fqdn string, entry *nameEntry) {
+	m.names[fqdn] = entry
+}
+
+// Lookup returns the names that point to the given address.
+func (m *reverseMapper) Lookup(addr netip.Addr) []string {
+	if addrs := m.addrs.Load(); addrs != nil {
+		return (*addrs)[addr]
+	}
+	return nil
+}
+
+// Run periodically resolves all names until the context is canceled.
+func (m *reverseMapper) Run(ctx context.Context) {
+	ticker := time.NewTicker(reverseRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		m.refresh(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *reverseMapper) refresh(ctx context.Context) {
+	addrs := make(map[netip.Addr][]string)
+
+	for _, fqdn := range slices.Sorted(maps.Keys(m.names)) {
+		for _, addr := range m.names[fqdn].resolve(ctx, m.resolver) {
+			addr = addr.Unmap()
+			if tailscaleRange.Contains(addr) && !slices.Contains(addrs[addr], fqdn) {
+				addrs[addr] = append(addrs[addr], fqdn)
+			}
+		}
+	}
+
+	if ctx.Err() == nil {
+		m.addrs.Store(&addrs)
+	}
+}
+
+// resolve returns the addresses that the entry currently points to.
+func (e *nameEntry) resolve(ctx context.Context, resolver ipResolver) []netip.Addr {
+	if e.addrs != nil {
+		return e.addrs()
+	}
+
+	var addrs []netip.Addr
+	for _, target := range e.targets {
+		ips, err := target.lookupIP(ctx, resolver, "ip")
+		if err != nil {
+			slog.Debug(
+				"failed to resolve target for reverse lookups",
+				"target", target.target,
+				"err", err)
+			continue
+		}
+		for _, ip := range ips {
+			if addr, ok := netip.AddrFromSlice(ip); ok {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	return addrs
+}
+
+// reverseHandler answers PTR queries for Tailscale addresses that names in the
+// zones point to. All other queries are passed to next.
+func reverseHandler(store *zoneStore, next dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		set := store.Zones()
+		q := req.Question[0]
+
+		if set.reverse == nil || q.Qtype != dns.TypePTR || q.Qclass != dns.ClassINET {
+			next.ServeDNS(w, req)
+			return
+		}
+
+		addr, ok := parseReverseName(q.Name)
+		if !ok || !tailscaleRange.Contains(addr) {
+			next.ServeDNS(w, req)
+			return
+		}
+
+		names := set.reverse.Lookup(addr)
+		if len(names) == 0 {
+			next.ServeDNS(w, req)
+			return
+		}
+
+		resp := newResponse(req)
+		resp.Authoritative = true
+
+		ttl := uint32(time.Duration(set.cfg.Expire) / time.Second)
+		for _, name := range names {
+			resp.Answer = append(resp.Answer, &dns.PTR{
+				Hdr: dns.RR_Header{
+					Name:   q.Name,
+					Rrtype: dns.TypePTR,
+					Class:  dns.ClassINET,
+					Ttl:    ttl,
+				},
+				Ptr: name,
+			})
+		}
+
+		w.WriteMsg(resp)
+	})
+}
+
+// parseReverseName parses an in-addr.arpa name into its IPv4 address.
+func parseReverseName(name string) (netip.Addr, bool) {
+	name, ok := strings.CutSuffix(strings.ToLower(dns.Fqdn(name)), ".in-addr.arpa.")
+	if !ok {
+		return netip.Addr{}, false
+	}
+
+	labels := strings.Split(name, ".")
+	if len(labels) != 4 {
+		return netip.Addr{}, false
+	}
+	slices.Reverse(labels)
+
+	addr, err := netip.ParseAddr(strings.Join(labels, "."))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr, true
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// Values of Config.RootQueries.
+const (
+	// rootProxy handles queries for the root zone like those for any other
+	// name outside of the zones, which forwards them to the fallback.
+	rootProxy = "proxy"
+	// rootRefuse refuses queries for the root zone.
+	rootRefuse = "refuse"
+	// rootHints answers NS queries for the root zone with the root servers
+	// and refuses all other queries for it, like a resolver that is primed
+	// from its root hints.
+	rootHints = "hints"
+)
+
+// rootHintsTTL is the TTL of the records in the root hints file of IANA.
+const rootHintsTTL = 518400
+
+// rootServers are the root servers of the root hints file of IANA
+// (https://www.internic.net/domain/named.root).
+var rootServers = []struct {
+	name string
+	ipv4 string
+	ipv6 string
+}{
+	{"a.root-servers.net.", "198.41.0.4", "2001:503:ba3e::2:30"},
+	{"b.root-servers.net.", "170.247.170.2", "2801:1b8:10::b"},
+	{"c.root-servers.net.", "192.33.4.12", "2001:500:2::c"},
+	{"d.root-servers.net.", "199.7.91.13", "2001:500:2d::d"},
+	{"e.root-servers.net.", "192.203.230.10", "2001:500:a8::e"},
+	{"f.root-servers.net.", "192.5.5.241", "2001:500:2f::f"},
+	{"g.root-servers.net.", "192.112.36.4", "2001:500:12::d0d"},
+	{"h.root-servers.net.", "198.97.190.53", "2001:500:1::53"},
+	{"i.root-servers.net.", "192.36.148.17", "2001:7fe::53"},
+	{"j.root-servers.net.", "192.58.128.30", "2001:503:c27::2:30"},
+	{"k.root-servers.net.", "193.0.14.129", "2001:7fd::1"},
+	{"l.root-servers.net.", "199.7.83.42", "2001:500:9f::42"},
+	{"m.root-servers.net.", "202.12.27.33", "2001:dc3::35"},
+}
+
+// rootHandler answers queries for the root zone according to root_queries,
+// unless the root zone is one of the zones. All other queries are handed to
+// h.
+func rootHandler(store *zoneStore, h dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		set := store.Zones()
+		mode := set.cfg.RootQueries
+		if mode == rootProxy || req.Question[0].Name != "." || set.served(".") != nil {
+			h.ServeDNS(w, req)
+			return
+		}
+
+		if mode == rootHints && req.Question[0].Qtype == dns.TypeNS {
+			resp := rootHintsResponse(req)
+			truncateResponse(w, req, resp, set.cfg.Truncation)
+			w.WriteMsg(resp)
+			return
+		}
+
+		slog.Debug(
+			"refusing root zone query",
+			"client", clientAddr(w),
+			"qtype", dns.TypeToString[req.Question[0].Qtype],
+			"root_queries", mode)
+		w.WriteMsg(errorResponse(req, dns.RcodeRefused, dns.ExtendedErrorCodeNotAuthoritative, ""))
+	})
+}
+
+// rootHintsResponse returns the NS records of the root zone with the addresses
+// of the root servers as glue.
+func rootHintsResponse(req *dns.Msg) *dns.Msg {
+	resp := newResponse(req)
+
+	for _, s := range rootServers {
+		resp.Answer = append(resp.Answer, &dns.NS{
+			Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: rootHintsTTL},
+			Ns:  s.name,
+		})
+		resp.Extra = append(resp.Extra,
+			&dns.A{
+				Hdr: dns.RR_Header{Name: s.name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: rootHintsTTL},
+				A:   net.ParseIP(s.ipv4),
+			},
+			&dns.AAAA{
+				Hdr:  dns.RR_Header{Name: s.name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: rootHintsTTL},
+				AAAA: net.ParseIP(s.ipv6),
+			})
+	}
+	return resp
+}
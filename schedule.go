@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ScheduleConfig switches a name to another target during a time window that
+// recurs every day or on some weekdays, such as a maintenance window.
+type ScheduleConfig struct {
+	// Start and End are the times of day of the window as "15:04". If End is
+	// not after Start, then the window lasts past midnight into the next day.
+	Start string `toml:"start"`
+	End   string `toml:"end"`
+	// Days are the weekdays such as "mon" or "sat" that the window starts on.
+	// It starts on every day if this is empty.
+	Days []string `toml:"days"`
+	// Timezone is the IANA time zone such as "Europe/Berlin" that Start and
+	// End are in. It defaults to the local time zone of the server, which is
+	// usually set by $TZ or /etc/localtime.
+	Timezone string `toml:"timezone"`
+	// Target is served instead of the name's targets during the window.
+	Target string `toml:"target"`
+}
+
+// schedule is a parsed ScheduleConfig.
+type schedule struct {
+	start, end time.Duration // since midnight
+	days       [7]bool       // by time.Weekday, all false for every day
+	loc        *time.Location
+	target     *nameTarget
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func (c ScheduleConfig) parse() (*schedule, error) {
+	s := &schedule{loc: time.Local}
+
+	var err error
+	if s.start, err = parseTimeOfDay(c.Start); err != nil {
+		return nil, fmt.Errorf("invalid start: %w", err)
+	}
+	if s.end, err = parseTimeOfDay(c.End); err != nil {
+		return nil, fmt.Errorf("invalid end: %w", err)
+	}
+
+	for _, day := range c.Days {
+		weekday, ok := weekdays[strings.ToLower(day)]
+		if !ok {
+			return nil, fmt.Errorf("invalid day %q, must be one of mon, tue, wed, thu, fri, sat or sun", day)
+		}
+		s.days[weekday] = true
+	}
+
+	if c.Timezone != "" {
+		if s.loc, err = time.LoadLocation(c.Timezone); err != nil {
+			return nil, fmt.Errorf("invalid timezone: %w", err)
+		}
+	}
+
+	if c.Target == "" {
+		return nil, fmt.Errorf("no target")
+	}
+	if s.target, err = newNameTarget(TargetConfig{Target: c.Target, Weight: 1}); err != nil {
+		return nil, fmt.Errorf("invalid target %q: %w", c.Target, err)
+	}
+
+	return s, nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// active returns whether the window of the schedule contains now.
+func (s *schedule) active(now time.Time) bool {
+	now = now.In(s.loc)
+	// Use the wall clock, so that windows follow daylight saving time.
+	h, m, sec := now.Clock()
+	sinceMidnight := time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(sec)*time.Second
+
+	startsOn := func(day time.Weekday) bool {
+		return s.days == [7]bool{} || s.days[day]
+	}
+
+	if s.start < s.end {
+		return startsOn(now.Weekday()) && sinceMidnight >= s.start && sinceMidnight < s.end
+	}
+	// The window lasts past midnight, so it may also have started yesterday.
+	yesterday := (now.Weekday() + 6) % 7
+	return (startsOn(now.Weekday()) && sinceMidnight >= s.start) ||
+		(startsOn(yesterday) && sinceMidnight < s.end)
+}
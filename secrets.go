@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+)
+
+// secretResolvers resolves secret references of the form <scheme>://<ref> by
+// their scheme. Other secret managers can be supported by adding to this.
+var secretResolvers = map[string]func(ctx context.Context, ref string) ([]byte, error){
+	"file": func(ctx context.Context, path string) ([]byte, error) {
+		return os.ReadFile(path)
+	},
+	"env": func(ctx context.Context, name string) ([]byte, error) {
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, fmt.Errorf("$%s is not set", name)
+		}
+		return []byte(v), nil
+	},
+}
+
+// isSecretURI returns true if s is a secret reference with a scheme.
+func isSecretURI(s string) bool {
+	return strings.Contains(s, "://")
+}
+
+// resolveSecret resolves the given secret reference. References without a
+// scheme are read as file paths.
+func resolveSecret(ctx context.Context, uri string) ([]byte, error) {
+	scheme, ref, ok := strings.Cut(uri, "://")
+	if !ok {
+		scheme, ref = "file", uri
+	}
+
+	resolve, ok := secretResolvers[scheme]
+	if !ok {
+		return nil, fmt.Errorf("unknown secret scheme %q, must be one of %q", scheme, slices.Sorted(maps.Keys(secretResolvers)))
+	}
+
+	v, err := resolve(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s secret: %w", scheme, err)
+	}
+	return v, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Values of Config.Serial.
+const (
+	// serialFixed always serves the serial 1 like newdns does.
+	serialFixed = ""
+	// serialUnixTime uses the Unix time of the rebuild.
+	serialUnixTime = "unixtime"
+	// serialDateCounter uses the date of the rebuild followed by a two digit
+	// counter of the rebuilds within that day (YYYYMMDDnn).
+	serialDateCounter = "date-counter"
+	// serialIncrement increments the serial on every rebuild.
+	serialIncrement = "increment"
+)
+
+// nextSerial returns the serial that follows prev for the given strategy.
+// Serials never go backwards, even if the clock does.
+func nextSerial(strategy string, prev uint32, now time.Time) uint32 {
+	switch strategy {
+	case serialUnixTime:
+		return max(uint32(now.Unix()), prev+1)
+	case serialDateCounter:
+		y, m, d := now.UTC().Date()
+		return max(uint32(y*1000000+int(m)*10000+d*100), prev+1)
+	case serialIncrement:
+		return prev + 1
+	default:
+		return 1
+	}
+}
+
+// loadSerial reads the serial that was last saved to path. It returns 0 if the
+// file does not exist yet.
+func loadSerial(path string) (uint32, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	serial, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid serial in %q: %w", path, err)
+	}
+	return uint32(serial), nil
+}
+
+// saveSerial atomically writes the serial to path.
+func saveSerial(path string, serial uint32) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create serial file: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := fmt.Fprintln(f, serial); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write serial file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write serial file: %w", err)
+	}
+
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace serial file: %w", err)
+	}
+	return nil
+}
+
+// setSerial sets the serial of the SOA records in the response.
+func setSerial(resp *dns.Msg, serial uint32) {
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns} {
+		for _, rr := range section {
+			if soa, ok := rr.(*dns.SOA); ok {
+				soa.Serial = serial
+			}
+		}
+	}
+}
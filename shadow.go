@@ -0,0 +1,132 @@
+package main
+
+import (
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// shadowMaxInFlight is how many shadow queries may be in flight at once.
+// Queries beyond it are not compared, so that a slow fallback cannot pile up
+// goroutines.
+const shadowMaxInFlight = 64
+
+// shadowHandler hands all queries to h, and compares the fraction
+// debug.shadow_compare of its authoritative answers against the answers of
+// fallback_dns in the background. Differences are logged, but the client
+// always gets the answer of h.
+func shadowHandler(store *zoneStore, h dns.Handler) dns.Handler {
+	cfg := store.Zones().cfg
+
+	client := new(dns.Client)
+	if cfg.FallbackSource.IsValid() {
+		client.Dialer = &net.Dialer{
+			LocalAddr: net.UDPAddrFromAddrPort(netip.AddrPortFrom(cfg.FallbackSource, 0)),
+		}
+	}
+	inFlight := make(chan struct{}, shadowMaxInFlight)
+
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		set := store.Zones()
+		fraction := set.cfg.Debug.ShadowCompare
+		if fraction <= 0 || set.cfg.FallbackDNS == "" || rand.Float64() >= fraction {
+			h.ServeDNS(w, req)
+			return
+		}
+
+		sw := &shadowResponseWriter{ResponseWriter: w}
+		h.ServeDNS(sw, req)
+
+		ours := sw.msg
+		if ours == nil || !ours.Authoritative {
+			// Forwarded answers come from the fallback anyway.
+			return
+		}
+
+		select {
+		case inFlight <- struct{}{}:
+		default:
+			slog.Debug(
+				"too many shadow queries in flight, not comparing",
+				"name", req.Question[0].Name)
+			return
+		}
+
+		shadowReq := req.Copy()
+		go func() {
+			defer func() { <-inFlight }()
+			compareShadow(client, set.cfg.FallbackDNS, shadowReq, ours)
+		}()
+	})
+}
+
+// compareShadow queries addr for the question of req and logs whether its
+// answer differs from ours. Only the response codes and the data of the
+// answer records of the queried type are compared, so that e.g. a finalized
+// answer matches the CNAME chain that the fallback resolves to the same
+// addresses.
+func compareShadow(client *dns.Client, addr string, req, ours *dns.Msg) {
+	q := req.Question[0]
+	slog := slog.With(
+		"name", q.Name,
+		"qtype", dns.TypeToString[q.Qtype],
+		"fallback", addr)
+
+	theirs, err := forward(client, req, addr, false)
+	if err != nil {
+		slog.Warn(
+			"failed to query fallback for shadow comparison",
+			"err", err)
+		return
+	}
+
+	ourData := shadowAnswerData(ours, q.Qtype)
+	theirData := shadowAnswerData(theirs, q.Qtype)
+	if ours.Rcode == theirs.Rcode && slices.Equal(ourData, theirData) {
+		slog.Debug(
+			"shadow answer matches fallback")
+		return
+	}
+
+	slog.Warn(
+		"answer differs from fallback",
+		"rcode", dns.RcodeToString[ours.Rcode],
+		"fallback_rcode", dns.RcodeToString[theirs.Rcode],
+		"answers", ourData,
+		"fallback_answers", theirData)
+}
+
+// shadowAnswerData returns the sorted data of the answer records of m that are
+// of the given type, without their owner names and TTLs.
+func shadowAnswerData(m *dns.Msg, qtype uint16) []string {
+	var data []string
+	for _, rr := range m.Answer {
+		if rr.Header().Rrtype != qtype && qtype != dns.TypeANY {
+			continue
+		}
+		hdr := rr.Header().String()
+		data = append(data, strings.ToLower(strings.TrimPrefix(rr.String(), hdr)))
+	}
+	slices.Sort(data)
+	return slices.Compact(data)
+}
+
+// shadowResponseWriter remembers the response that was written, so that it can
+// be compared.
+type shadowResponseWriter struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (w *shadowResponseWriter) Unwrap() dns.ResponseWriter { return w.ResponseWriter }
+
+func (w *shadowResponseWriter) WriteMsg(m *dns.Msg) error {
+	// The response may still be changed by the writer, such as to pad it.
+	w.msg = m.Copy()
+	return w.ResponseWriter.WriteMsg(m)
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/256dpi/newdns"
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteConfig configures a SQLite database to serve zones from, such as one
+// that is edited by a separate admin tool. The database is only ever read.
+type SQLiteConfig struct {
+	Path string `toml:"path"`
+	// Table is the table of the records. It defaults to "records". It must
+	// have the columns zone, name and target, and may have the columns type
+	// and ttl, see [sqliteRowsToZones].
+	Table string `toml:"table"`
+	// Interval is how often the database is checked for changes. It defaults
+	// to 5 seconds.
+	Interval tomlDuration `toml:"interval"`
+}
+
+// sqliteBusyTimeout is how long reading the database waits for a writer to
+// release its lock.
+const sqliteBusyTimeout = 5 * time.Second
+
+// loadSQLite loads the zones of the database into the store.
+func loadSQLite(store *zoneStore, cfg SQLiteConfig) error {
+	columns, rows, err := readSQLiteTable(cfg.Path, cmp.Or(cfg.Table, "records"))
+	if err != nil {
+		return err
+	}
+
+	zones, err := sqliteRowsToZones(columns, rows)
+	if err != nil {
+		return err
+	}
+
+	if err := store.SetDynamicZones("sqlite", zones); err != nil {
+		return fmt.Errorf("failed to apply zones from SQLite: %w", err)
+	}
+	return nil
+}
+
+// readSQLiteTable returns the columns and rows of the table. The database is
+// opened read-only, and the table is read in a single transaction, so that the
+// rows are consistent while another process writes to the database.
+func readSQLiteTable(path, table string) ([]string, [][]any, error) {
+	dsn := (&url.URL{
+		Scheme: "file",
+		Opaque: path,
+		RawQuery: url.Values{
+			"mode":    {"ro"},
+			"_pragma": {fmt.Sprintf("busy_timeout(%d)", sqliteBusyTimeout.Milliseconds())},
+		}.Encode(),
+	}).String()
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open SQLite database: %w", err)
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open SQLite database: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(fmt.Sprintf(`SELECT * FROM "%s"`, strings.ReplaceAll(table, `"`, `""`)))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read table %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read table %s: %w", table, err)
+	}
+
+	var values [][]any
+	for rows.Next() {
+		row := make([]any, len(columns))
+		ptrs := make([]any, len(columns))
+		for i := range row {
+			ptrs[i] = &row[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, nil, fmt.Errorf("failed to read table %s: %w", table, err)
+		}
+		values = append(values, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("failed to read table %s: %w", table, err)
+	}
+	return columns, values, nil
+}
+
+// watchSQLite reloads the database whenever it or its write-ahead log change
+// until the context is canceled. Changes are polled for, since SQLite has no
+// change notifications for other processes.
+func watchSQLite(ctx context.Context, store *zoneStore, cfg SQLiteConfig) error {
+	slog := slog.With(
+		"component", "sqlite",
+		"path", cfg.Path)
+
+	interval := time.Duration(cfg.Interval)
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+
+	last := sqliteStat(cfg.Path)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		stat := sqliteStat(cfg.Path)
+		if slices.EqualFunc(stat, last, func(a, b fs.FileInfo) bool {
+			return (a == nil) == (b == nil) && (a == nil || !fileChanged(a, b))
+		}) {
+			continue
+		}
+		last = stat
+
+		if err := loadSQLite(store, cfg); err != nil {
+			slog.Error(
+				"failed to reload SQLite database, keeping the old zones",
+				"err", err)
+			continue
+		}
+
+		slog.Info(
+			"reloaded zones from SQLite")
+	}
+}
+
+// sqliteStat returns the file info of the database and its write-ahead log,
+// which are nil for files that don't exist.
+func sqliteStat(path string) []fs.FileInfo {
+	stat := make([]fs.FileInfo, 2)
+	stat[0], _ = os.Stat(path)
+	stat[1], _ = os.Stat(path + "-wal")
+	return stat
+}
+
+// sqliteRowsToZones turns the rows of the records table into zones. Every row
+// adds to the entry of its name in its zone, where the name "@" is the zone
+// apex:
+//
+//   - type "cname", "a" or "alias" adds the target with that as, and "" or
+//     NULL adds it like a plain target of the config file. "aaaa" is the same
+//     as "a".
+//   - type "txt" adds the target as a TXT record.
+//   - ttl, if not NULL, is the TTL of the entry in seconds.
+func sqliteRowsToZones(columns []string, rows [][]any) (map[string]ZoneConfig, error) {
+	index := make(map[string]int, len(columns))
+	for i, column := range columns {
+		index[strings.ToLower(column)] = i
+	}
+	for _, column := range []string{"zone", "name", "target"} {
+		if _, ok := index[column]; !ok {
+			return nil, fmt.Errorf("records table has no %s column", column)
+		}
+	}
+
+	text := func(row []any, column string) (string, error) {
+		i, ok := index[column]
+		if !ok || i >= len(row) || row[i] == nil {
+			return "", nil
+		}
+		switch v := row[i].(type) {
+		case string:
+			return v, nil
+		case []byte:
+			return string(v), nil
+		default:
+			return "", fmt.Errorf("%s is not text", column)
+		}
+	}
+
+	type key struct{ zone, name string }
+	tables := make(map[key]map[string]any)
+	var keys []key
+
+	for n, row := range rows {
+		var k key
+		var typ, target string
+		var err error
+		for _, read := range []struct {
+			column string
+			v      *string
+		}{
+			{"zone", &k.zone},
+			{"name", &k.name},
+			{"type", &typ},
+			{"target", &target},
+		} {
+			if *read.v, err = text(row, read.column); err != nil {
+				return nil, fmt.Errorf("row %d: %w", n+1, err)
+			}
+		}
+		if k.zone == "" || k.name == "" {
+			return nil, fmt.Errorf("row %d: zone and name must be set", n+1)
+		}
+		// The zone apex is written as "@" like in zone files.
+		k.zone = newdns.NormalizeDomain(k.zone, true, true, false)
+		if k.name == "@" {
+			k.name = ""
+		}
+
+		table := tables[k]
+		if table == nil {
+			table = make(map[string]any)
+			tables[k] = table
+			keys = append(keys, k)
+		}
+
+		switch typ = strings.ToLower(typ); typ {
+		case "txt":
+			txt, _ := table["txt"].([]any)
+			table["txt"] = append(txt, target)
+		case "", entryAsCNAME, entryAsA, "aaaa", entryAsAlias:
+			if typ == "aaaa" {
+				typ = entryAsA
+			}
+			if typ != "" {
+				if as, ok := table["as"]; ok && as != typ {
+					return nil, fmt.Errorf("row %d: %s in zone %s has rows of types %s and %s", n+1, k.name, k.zone, as, typ)
+				}
+				table["as"] = typ
+			}
+			targets, _ := table["targets"].([]any)
+			table["targets"] = append(targets, map[string]any{"target": target})
+		default:
+			return nil, fmt.Errorf("row %d: unsupported type %q", n+1, typ)
+		}
+
+		if i, ok := index["ttl"]; ok && i < len(row) && row[i] != nil {
+			secs, ok := row[i].(int64)
+			if !ok || secs < 0 {
+				return nil, fmt.Errorf("row %d: ttl must be a number of seconds", n+1)
+			}
+			table["ttl"] = (time.Duration(secs) * time.Second).String()
+		}
+	}
+
+	zones := make(map[string]ZoneConfig)
+	for _, k := range keys {
+		entry, err := parseZoneEntry(tables[k], nil, true)
+		if err != nil {
+			return nil, fmt.Errorf("invalid entry %s in zone %s: %w", k.name, k.zone, err)
+		}
+		if zones[k.zone] == nil {
+			zones[k.zone] = make(ZoneConfig)
+		}
+		if k.name == "" && entry.As == entryAsCNAME {
+			return nil, fmt.Errorf("the apex of zone %s cannot be served as a CNAME", k.zone)
+		}
+		zones[k.zone][k.name] = entry
+	}
+	return zones, nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSQLiteRowsToZones(t *testing.T) {
+	columns := []string{"Zone", "name", "type", "target", "ttl"}
+	rows := [][]any{
+		{"example.com", "@", "alias", "lb.example.net", nil},
+		{"example.com", "www", nil, "a.example.net", int64(60)},
+		{"example.com", "www", "", []byte("b.example.net"), nil},
+		{"example.com", "www", "TXT", "v=spf1 -all", nil},
+		{"Other.Test.", "db", "aaaa", "db.internal", nil},
+	}
+
+	zones, err := sqliteRowsToZones(columns, rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(zones) != 2 {
+		t.Fatalf("got zones %v, want 2", zones)
+	}
+
+	apex := zones["example.com."][""]
+	if apex.As != entryAsAlias || !slices.Equal(entryTargets(apex), []string{"lb.example.net"}) {
+		t.Errorf("apex = %+v, want alias of lb.example.net", apex)
+	}
+
+	www := zones["example.com."]["www"]
+	if !slices.Equal(entryTargets(www), []string{"a.example.net", "b.example.net"}) {
+		t.Errorf("www targets = %v", entryTargets(www))
+	}
+	if !slices.Equal(www.TXT, []string{"v=spf1 -all"}) {
+		t.Errorf("www TXT = %v", www.TXT)
+	}
+	if www.TTL == nil || time.Duration(*www.TTL) != time.Minute {
+		t.Errorf("www TTL = %v, want 1m", www.TTL)
+	}
+
+	if db := zones["other.test."]["db"]; db.As != entryAsA {
+		t.Errorf("db as = %q, want %q", db.As, entryAsA)
+	}
+}
+
+func TestSQLiteRowsToZonesErrors(t *testing.T) {
+	columns := []string{"zone", "name", "type", "target", "ttl"}
+	tests := []struct {
+		name    string
+		columns []string
+		rows    [][]any
+		err     string
+	}{
+		{
+			name:    "missing column",
+			columns: []string{"zone", "name"},
+			err:     "no target column",
+		},
+		{
+			name:    "missing name",
+			columns: columns,
+			rows:    [][]any{{"example.com", nil, nil, "a.example.net", nil}},
+			err:     "zone and name must be set",
+		},
+		{
+			name:    "unsupported type",
+			columns: columns,
+			rows:    [][]any{{"example.com", "www", "mx", "a.example.net", nil}},
+			err:     `unsupported type "mx"`,
+		},
+		{
+			name:    "conflicting types",
+			columns: columns,
+			rows: [][]any{
+				{"example.com", "www", "cname", "a.example.net", nil},
+				{"example.com", "www", "a", "b.example.net", nil},
+			},
+			err: "has rows of types cname and a",
+		},
+		{
+			name:    "negative ttl",
+			columns: columns,
+			rows:    [][]any{{"example.com", "www", nil, "a.example.net", int64(-1)}},
+			err:     "ttl must be a number of seconds",
+		},
+		{
+			name:    "cname apex",
+			columns: columns,
+			rows:    [][]any{{"example.com", "@", "cname", "a.example.net", nil}},
+			err:     "cannot be served as a CNAME",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := sqliteRowsToZones(test.columns, test.rows)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("got error %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestReadSQLiteTable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "zones.db")
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, stmt := range []string{
+		`PRAGMA journal_mode = WAL`,
+		`CREATE TABLE records (zone TEXT, name TEXT, type TEXT, target TEXT, ttl INTEGER)`,
+		`INSERT INTO records VALUES ('example.com', 'www', 'cname', 'a.example.net', 30)`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	columns, rows, err := readSQLiteTable(path, "records")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zones, err := sqliteRowsToZones(columns, rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if www := zones["example.com."]["www"]; www.As != entryAsCNAME {
+		t.Errorf("www = %+v, want a CNAME", www)
+	}
+
+	if _, _, err := readSQLiteTable(path, "missing"); err == nil {
+		t.Error("reading a missing table succeeded")
+	}
+}
+
+func entryTargets(entry ZoneEntry) []string {
+	var targets []string
+	for _, target := range entry.Targets {
+		targets = append(targets, target.Target)
+	}
+	return targets
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// queryStats counts the queries that were handled for each zone, and those for
+// names outside of the zones. It is safe for concurrent use.
+type queryStats struct {
+	zones    sync.Map // zone -> *atomic.Uint64
+	fallback atomic.Uint64
+	// started is when counting started.
+	started time.Time
+}
+
+func newQueryStats() *queryStats {
+	return &queryStats{started: time.Now()}
+}
+
+// count counts a query for the zone, or for names outside of the zones if
+// zone is empty. It does nothing if s is nil.
+func (s *queryStats) count(zone string) {
+	if s == nil {
+		return
+	}
+	if zone == "" {
+		s.fallback.Add(1)
+		return
+	}
+
+	n, ok := s.zones.Load(zone)
+	if !ok {
+		n, _ = s.zones.LoadOrStore(zone, new(atomic.Uint64))
+	}
+	n.(*atomic.Uint64).Add(1)
+}
+
+// snapshot returns the counts of every zone and of names outside of them.
+func (s *queryStats) snapshot() (zones map[string]uint64, fallback uint64) {
+	zones = make(map[string]uint64)
+	for zone, n := range s.zones.Range {
+		zones[zone.(string)] = n.(*atomic.Uint64).Load()
+	}
+	return zones, s.fallback.Load()
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/256dpi/newdns"
+	"github.com/miekg/dns"
+)
+
+// statsTXTLabel is the label below the zones whose TXT records are the
+// counters of the server.
+const statsTXTLabel = "_stats"
+
+// StatsTXTConfig configures serving the counters of the server as TXT
+// records, for monitoring that can only make DNS queries.
+type StatsTXTConfig struct {
+	Enable bool `toml:"enable"`
+	// Allow are the networks that may query the counters. Defaults to
+	// loopback.
+	Allow []netip.Prefix `toml:"allow"`
+}
+
+// statsTXTHandler answers TXT queries for "_stats.<zone>" with the counters of
+// the server as "key=value" strings if stats_txt is enabled, and hands all
+// other queries to h. Clients outside of stats_txt.allow are refused.
+func statsTXTHandler(store *zoneStore, h dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		set := store.Zones()
+		if !set.cfg.StatsTXT.Enable {
+			h.ServeDNS(w, req)
+			return
+		}
+
+		name := newdns.NormalizeDomain(req.Question[0].Name, true, false, false)
+		label, zoneName, _ := strings.Cut(name, ".")
+		zone := set.served(zoneName)
+		if !strings.EqualFold(label, statsTXTLabel) || zone == nil || zone.Name != zoneName {
+			h.ServeDNS(w, req)
+			return
+		}
+
+		client := clientAddr(w)
+		if !prefixesContain(set.cfg.StatsTXT.Allow, client) {
+			slog.Debug(
+				"refusing stats query from disallowed client",
+				"client", client,
+				"name", name)
+			w.WriteMsg(errorResponse(req, dns.RcodeRefused, dns.ExtendedErrorCodeProhibited, ""))
+			return
+		}
+
+		resp := newResponse(req)
+		resp.Authoritative = true
+
+		qtype := req.Question[0].Qtype
+		if qtype == dns.TypeTXT || qtype == dns.TypeANY {
+			for _, kv := range statsTXTValues(store, set, zone.Name) {
+				resp.Answer = append(resp.Answer, &dns.TXT{
+					// The counters change with every query, so they are never
+					// cached.
+					Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+					Txt: []string{kv},
+				})
+			}
+		}
+
+		w.WriteMsg(resp)
+	})
+}
+
+// statsTXTValues returns the counters of the server and of the zone as
+// "key=value" strings.
+func statsTXTValues(store *zoneStore, set *zoneSet, zone string) []string {
+	zones, fallback := store.stats.snapshot()
+
+	var total uint64
+	for _, n := range zones {
+		total += n
+	}
+
+	return []string{
+		fmt.Sprintf("uptime=%d", int64(time.Since(store.stats.started)/time.Second)),
+		fmt.Sprintf("queries=%d", zones[zone]),
+		fmt.Sprintf("queries_total=%d", total),
+		fmt.Sprintf("fallback_queries=%d", fallback),
+		fmt.Sprintf("cache_hits=%d", set.cache.hits.Load()),
+		fmt.Sprintf("cache_misses=%d", set.cache.misses.Load()),
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/256dpi/newdns"
+)
+
+// zoneStore holds the zone set that is currently being served. The zone set is
+// rebuilt from its sources whenever one of them changes and then atomically
+// swapped in, so queries never observe a partially updated set.
+type zoneStore struct {
+	ctx  context.Context
+	opts zoneSetOptions
+	set  atomic.Pointer[zoneSet]
+	// stats counts the queries of the zones across reloads.
+	stats *queryStats
+	// acme, if not nil, are the records of ACME challenges that are served
+	// over the zones.
+	acme *acmeRecords
+
+	mu          sync.Mutex
+	cfg         *Config
+	dynamic     map[string]map[string]ZoneConfig // source -> zones
+	serial      uint32
+	stopChecker context.CancelFunc
+}
+
+func newZoneStore(ctx context.Context, cfg *Config, opts zoneSetOptions) (*zoneStore, error) {
+	opts.Cache = newResolveCacheEntries()
+	opts.ExternalCache = newResolveCacheEntries()
+
+	s := &zoneStore{
+		ctx:   ctx,
+		opts:  opts,
+		cfg:   cfg,
+		stats: newQueryStats(),
+	}
+	if cfg.Serial != serialFixed && cfg.SerialFile != "" {
+		serial, err := loadSerial(cfg.SerialFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load serial: %w", err)
+		}
+		s.serial = serial
+	}
+	if err := s.rebuild(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Zones returns the current zone set.
+func (s *zoneStore) Zones() *zoneSet {
+	return s.set.Load()
+}
+
+// SetConfig replaces the zones from the config file.
+func (s *zoneStore) SetConfig(cfg *Config) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old := s.cfg
+	s.cfg = cfg
+	if err := s.rebuild(); err != nil {
+		s.cfg = old
+		return err
+	}
+	return nil
+}
+
+// SetDynamicZones replaces the zones from the given dynamic source. They are
+// merged on top of the zones from the config file.
+func (s *zoneStore) SetDynamicZones(source string, zones map[string]ZoneConfig) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old := s.dynamic
+	s.dynamic = maps.Clone(old)
+	if s.dynamic == nil {
+		s.dynamic = make(map[string]map[string]ZoneConfig)
+	}
+	s.dynamic[source] = zones
+
+	if err := s.rebuild(); err != nil {
+		s.dynamic = old
+		return err
+	}
+	return nil
+}
+
+// rebuild builds a new zone set from the sources and swaps it in. The current
+// set is neither used nor modified while building, so it keeps being served
+// unchanged if building fails.
+func (s *zoneStore) rebuild() error {
+	zones := s.cfg.Zones
+	for _, source := range slices.Sorted(maps.Keys(s.dynamic)) {
+		zones = mergeZones(zones, s.dynamic[source])
+	}
+
+	set, err := buildZoneSet(s.ctx, s.cfg, zones, s.opts)
+	if err != nil {
+		return err
+	}
+
+	// Bump the serial on every rebuild so that secondaries notice changes.
+	set.serial = nextSerial(s.cfg.Serial, s.serial, time.Now())
+	if set.serial != s.serial && s.cfg.Serial != serialFixed && s.cfg.SerialFile != "" {
+		if err := saveSerial(s.cfg.SerialFile, set.serial); err != nil {
+			slog.Warn(
+				"failed to save serial, it may go backwards after a restart",
+				"path", s.cfg.SerialFile,
+				"err", err)
+		}
+	}
+	s.serial = set.serial
+
+	if old := s.set.Load(); old != nil {
+		set.checker.Inherit(old.checker)
+
+		// The cached addresses are kept, except those of targets that are no
+		// longer served.
+		targets := set.targets()
+		removed := make(map[string]bool)
+		for target := range old.targets() {
+			if !targets[target] {
+				removed[target] = true
+			}
+		}
+		set.cache.forget(removed)
+	}
+
+	checkerCtx, stopChecker := context.WithCancel(s.ctx)
+	go set.checker.Run(checkerCtx)
+	if set.reverse != nil {
+		go set.reverse.Run(checkerCtx)
+	}
+
+	s.set.Store(set)
+
+	if s.stopChecker != nil {
+		s.stopChecker()
+	}
+	s.stopChecker = stopChecker
+
+	return nil
+}
+
+// mergeZones returns the zones in base with the names in overlay added to
+// them. Names in overlay take precedence. Overlay zones that are within a zone
+// in base are placed into that zone rather than added as a separate zone.
+func mergeZones(base, overlay map[string]ZoneConfig) map[string]ZoneConfig {
+	if len(overlay) == 0 {
+		return base
+	}
+
+	merged := maps.Clone(base)
+	for zone, zcfg := range overlay {
+		var prefix string
+
+		// Zones that are not within a base zone are keyed by their normalized
+		// name, so that differently written names of a zone are merged.
+		normZone := newdns.NormalizeDomain(zone, true, true, false)
+		key := normZone
+		var bestZone string
+		for baseZone := range base {
+			normBase := newdns.NormalizeDomain(baseZone, true, true, false)
+			if newdns.InZone(normBase, normZone) && len(normBase) > len(bestZone) {
+				key, bestZone = baseZone, normBase
+			}
+		}
+		if bestZone != "" {
+			prefix = newdns.TrimZone(bestZone, normZone)
+		}
+
+		names := maps.Clone(merged[key])
+		if names == nil {
+			names = make(ZoneConfig, len(zcfg))
+		}
+		for name, entry := range zcfg {
+			names[joinName(name, prefix)] = entry
+		}
+		merged[key] = names
+	}
+
+	return merged
+}
+
+// joinName joins a relative name with a relative prefix.
+func joinName(name, prefix string) string {
+	switch {
+	case prefix == "":
+		return name
+	case name == "":
+		return prefix
+	default:
+		return name + "." + prefix
+	}
+}
+
+// zoneDiff is the difference between two sets of zones. Names are FQDNs.
+type zoneDiff struct {
+	zonesAdded   []string
+	zonesRemoved []string
+	namesAdded   []string
+	namesRemoved []string
+	namesChanged []string
+}
+
+// diffZones returns what changed from the zones in from to the zones in to.
+func diffZones(from, to map[string]ZoneConfig) zoneDiff {
+	normalize := func(zones map[string]ZoneConfig) map[string]map[string]ZoneEntry {
+		norm := make(map[string]map[string]ZoneEntry, len(zones))
+		for zone, zcfg := range zones {
+			zone = newdns.NormalizeDomain(zone, true, true, false)
+			if norm[zone] == nil {
+				norm[zone] = make(map[string]ZoneEntry, len(zcfg))
+			}
+			for name, entry := range zcfg {
+				norm[zone][joinDomain(strings.ToLower(name), zone)] = entry
+			}
+		}
+		return norm
+	}
+
+	oldZones := normalize(from)
+	newZones := normalize(to)
+
+	var diff zoneDiff
+	for zone := range oldZones {
+		if _, ok := newZones[zone]; !ok {
+			diff.zonesRemoved = append(diff.zonesRemoved, zone)
+		}
+	}
+	for zone := range newZones {
+		if _, ok := oldZones[zone]; !ok {
+			diff.zonesAdded = append(diff.zonesAdded, zone)
+		}
+	}
+
+	oldNames := make(map[string]ZoneEntry)
+	for _, names := range oldZones {
+		maps.Copy(oldNames, names)
+	}
+	newNames := make(map[string]ZoneEntry)
+	for _, names := range newZones {
+		maps.Copy(newNames, names)
+	}
+
+	for name, oldEntry := range oldNames {
+		newEntry, ok := newNames[name]
+		switch {
+		case !ok:
+			diff.namesRemoved = append(diff.namesRemoved, name)
+		case !reflect.DeepEqual(oldEntry, newEntry):
+			diff.namesChanged = append(diff.namesChanged, name)
+		}
+	}
+	for name := range newNames {
+		if _, ok := oldNames[name]; !ok {
+			diff.namesAdded = append(diff.namesAdded, name)
+		}
+	}
+
+	for _, names := range []*[]string{
+		&diff.zonesAdded, &diff.zonesRemoved,
+		&diff.namesAdded, &diff.namesRemoved, &diff.namesChanged,
+	} {
+		slices.Sort(*names)
+	}
+
+	return diff
+}
+
+// reloadOnSignal reloads the config file's zones into the store whenever
+// SIGHUP is received until the context is canceled.
+func reloadOnSignal(ctx context.Context, store *zoneStore, path string) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	defer signal.Stop(sig)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sig:
+		}
+
+		reload(store, path)
+	}
+}
+
+// reload reloads the zones from the config file at path like SIGHUP does and
+// logs what changed. The old zones are kept if it fails.
+func reload(store *zoneStore, path string) (zoneDiff, error) {
+	slog.Info(
+		"reloading config file",
+		"path", path)
+
+	oldZones := store.Zones().cfg.Zones
+
+	if err := reloadConfig(store, path); err != nil {
+		slog.Error(
+			"failed to reload config file, keeping the old zones",
+			"path", path,
+			"err", err)
+		return zoneDiff{}, err
+	}
+
+	diff := diffZones(oldZones, store.Zones().cfg.Zones)
+	slog.Info(
+		"reloaded config file",
+		"path", path,
+		"zones_added", diff.zonesAdded,
+		"zones_removed", diff.zonesRemoved,
+		"names_added", diff.namesAdded,
+		"names_removed", diff.namesRemoved,
+		"names_changed", diff.namesChanged)
+	return diff, nil
+}
+
+func reloadConfig(store *zoneStore, path string) error {
+	cfg, err := ParseConfigFile(path, strictConfig)
+	if err != nil {
+		return err
+	}
+	if err := store.SetConfig(cfg); err != nil {
+		return fmt.Errorf("failed to build zones: %w", err)
+	}
+	return nil
+}
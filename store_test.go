@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestReloadKeepsZonesOnError(t *testing.T) {
+	const valid = `
+[zones."a.test"]
+www = { target = "www.example.net", as = "cname" }
+`
+	path := writeTestConfig(t, "fallback_dns = \"\"\n"+valid)
+	cfg, err := ParseConfigFile(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := newTestStore(t, cfg, staticResolver{})
+	handler := newZoneHandler(store, nil)
+	old := store.Zones()
+
+	assertCNAME := func() {
+		t.Helper()
+		resp := query(t, handler, "www.a.test.", dns.TypeA)
+		if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) == 0 {
+			t.Fatalf("got response %v, want a CNAME", resp)
+		}
+		cname, ok := resp.Answer[0].(*dns.CNAME)
+		if !ok || cname.Target != "www.example.net." {
+			t.Fatalf("got answer %v, want a CNAME to www.example.net.", resp.Answer[0])
+		}
+	}
+	assertCNAME()
+
+	// The zone is written as a string where a table is expected.
+	broken := "fallback_dns = \"\"\nzones = \"a.test\"\n"
+	if err := os.WriteFile(path, []byte(broken), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reload(store, path); err == nil {
+		t.Fatal("reloading a broken config succeeded")
+	}
+
+	if store.Zones() != old {
+		t.Error("the zone set was replaced by a failed reload")
+	}
+	assertCNAME()
+
+	// An entry that parses but cannot be built.
+	invalid := "fallback_dns = \"\"\n[zones.\"a.test\"]\nwww = { target = \"www.example.net\", as = \"mx\" }\n"
+	if err := os.WriteFile(path, []byte(invalid), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reload(store, path); err == nil {
+		t.Fatal("reloading an invalid config succeeded")
+	}
+	assertCNAME()
+}
+
+func TestCacheKeptAcrossRebuilds(t *testing.T) {
+	const zones = `
+finalize = true
+finalize_cache_ttl = "1m"
+
+[zones."a.test"]
+www = "www.example.net"
+`
+	resolver := &countingResolver{
+		staticResolver: staticResolver{
+			"www.example.net.": {net.ParseIP("192.0.2.1")},
+			"old.example.net.": {net.ParseIP("192.0.2.2")},
+		},
+		lookups: make(map[string]int),
+	}
+	store := newTestStore(t, testConfig(t, zones+`old = "old.example.net"`), resolver)
+	handler := newZoneHandler(store, nil)
+
+	query(t, handler, "www.a.test.", dns.TypeA)
+	query(t, handler, "old.a.test.", dns.TypeA)
+
+	if err := store.SetConfig(testConfig(t, zones)); err != nil {
+		t.Fatal(err)
+	}
+
+	query(t, handler, "www.a.test.", dns.TypeA)
+	if n := resolver.count("www.example.net."); n != 1 {
+		t.Errorf("www.example.net. was resolved %d times, want once", n)
+	}
+
+	cache := store.Zones().cache
+	if n := cache.len(); n != 1 {
+		t.Errorf("got %d cached targets, want only www.example.net.", n)
+	}
+	if hits := cache.hits.Load(); hits != 1 {
+		t.Errorf("got %d cache hits, want 1", hits)
+	}
+}
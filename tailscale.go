@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"tailscale.com/client/tailscale"
+)
+
+const tailscaleIPsPollInterval = 30 * time.Second
+
+// checkTailscaleAddr checks that addr listens on port 53 of all addresses,
+// since the Tailscale listeners always listen on port 53 of the node's
+// Tailscale address. Any wildcard form such as ":53", "0.0.0.0:53" or "[::]:53"
+// is accepted.
+func checkTailscaleAddr(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if port != "53" {
+		return fmt.Errorf("port must be 53, not %q", port)
+	}
+	if host != "" {
+		ip, err := netip.ParseAddr(host)
+		if err != nil || !ip.IsUnspecified() {
+			return fmt.Errorf("host must be empty or a wildcard address, not %q", host)
+		}
+	}
+	return nil
+}
+
+// watchTailscaleIPs periodically stores the node's Tailscale IPs into addrs
+// until the context is canceled.
+func watchTailscaleIPs(ctx context.Context, lc *tailscale.LocalClient, addrs *atomic.Pointer[[]netip.Addr]) {
+	ticker := time.NewTicker(tailscaleIPsPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		status, err := lc.StatusWithoutPeers(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Warn(
+					"failed to get Tailscale status",
+					"err", err)
+			}
+			continue
+		}
+
+		if old := addrs.Load(); old != nil && slices.Equal(*old, status.TailscaleIPs) {
+			continue
+		}
+
+		slog.Info(
+			"Tailscale IPs changed",
+			"ips", status.TailscaleIPs)
+
+		ips := slices.Clone(status.TailscaleIPs)
+		addrs.Store(&ips)
+	}
+}
+
+// tailscaleAuthKey returns the auth key to register the node with. If key is
+// a Tailscale OAuth client secret, a new single-use auth key carrying the
+// configured tags is created with it, similar to `tailscale up`.
+func tailscaleAuthKey(ctx context.Context, key string, cfg TailscaleConfig) (string, error) {
+	if !strings.HasPrefix(key, "tskey-client-") {
+		if len(cfg.Tags) > 0 {
+			slog.Warn(
+				"tailscale.tags only apply to OAuth client secrets, using the tags of the auth key instead",
+				"component", "tailscale")
+		}
+		return key, nil
+	}
+
+	if len(cfg.Tags) == 0 {
+		return "", errors.New("tailscale.tags must be set when using an OAuth client secret")
+	}
+
+	baseURL := strings.TrimSuffix(cfg.APIURL, "/")
+	if baseURL == "" {
+		baseURL = "https://api.tailscale.com"
+	}
+
+	token, err := tailscaleOAuthToken(ctx, baseURL, key)
+	if err != nil {
+		return "", fmt.Errorf("failed to get OAuth access token: %w", err)
+	}
+
+	var body struct {
+		Capabilities struct {
+			Devices struct {
+				Create struct {
+					Reusable      bool     `json:"reusable"`
+					Ephemeral     bool     `json:"ephemeral"`
+					Preauthorized bool     `json:"preauthorized"`
+					Tags          []string `json:"tags"`
+				} `json:"create"`
+			} `json:"devices"`
+		} `json:"capabilities"`
+	}
+	create := &body.Capabilities.Devices.Create
+	create.Ephemeral = cfg.Ephemeral
+	create.Preauthorized = true
+	create.Tags = cfg.Tags
+
+	var created struct {
+		Key string `json:"key"`
+	}
+	if err := tailscaleAPIRequest(ctx, http.MethodPost, baseURL+"/api/v2/tailnet/-/keys", token, body, &created); err != nil {
+		return "", fmt.Errorf("failed to create auth key: %w", err)
+	}
+
+	return created.Key, nil
+}
+
+func tailscaleOAuthToken(ctx context.Context, baseURL, clientSecret string) (string, error) {
+	form := url.Values{
+		"client_secret": {clientSecret},
+		"grant_type":    {"client_credentials"},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, baseURL+"/api/v2/oauth/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := doTailscaleAPIRequest(req, &token); err != nil {
+		return "", err
+	}
+	return token.AccessToken, nil
+}
+
+func tailscaleAPIRequest(ctx context.Context, method, url, token string, body, dst any) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	return doTailscaleAPIRequest(req, dst)
+}
+
+func doTailscaleAPIRequest(req *http.Request, dst any) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(dst); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/pflag"
+)
+
+// runVerify queries a running server for every name in the configured zones
+// and compares its answers to the answers that the config produces, which are
+// computed by the same handler that serves them. It returns 1 if any answer
+// differs.
+func runVerify(ctx context.Context, args []string) int {
+	flags := pflag.NewFlagSet("verify", pflag.ContinueOnError)
+	addr := flags.StringP("addr", "a", "127.0.0.1:53", "address of the DNS server to verify")
+	timeout := flags.Duration("timeout", 2*time.Second, "timeout of every query")
+	qtypeName := flags.StringP("type", "t", "A", "type of the queries")
+	network := flags.String("net", "udp", "network to use, either udp or tcp")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	qtype, ok := dns.StringToType[*qtypeName]
+	if !ok {
+		slog.Error(
+			"unknown query type",
+			"type", *qtypeName)
+		return 2
+	}
+
+	cfg, err := ParseConfigFile(configPath, strictConfig)
+	if err != nil {
+		slog.Error(
+			"failed to parse config file",
+			"path", configPath,
+			"err", err)
+		return 1
+	}
+
+	set, err := buildConfigZoneSet(ctx, cfg)
+	if err != nil {
+		slog.Error(
+			"failed to build zones",
+			"err", err)
+		return 1
+	}
+
+	// Serve the zone set like run does, but without any sources that would
+	// rebuild it.
+	store := &zoneStore{ctx: ctx, cfg: cfg}
+	store.set.Store(set)
+	handler := newZoneHandler(store, nil)
+
+	client := &dns.Client{Net: *network, Timeout: *timeout}
+
+	var names, mismatches int
+	for _, zone := range slices.Sorted(maps.Keys(set.names)) {
+		entries := set.names[zone]
+		for _, name := range slices.Sorted(maps.Keys(entries)) {
+			if ctx.Err() != nil {
+				return 1
+			}
+
+			fqdn := joinDomain(name, zone)
+			req := new(dns.Msg)
+			req.SetQuestion(fqdn, qtype)
+
+			w := &verifyResponseWriter{}
+			handler.ServeDNS(w, req.Copy())
+			if w.msg == nil {
+				slog.Warn(
+					"config produces no answer for the name, skipping it",
+					"name", fqdn)
+				continue
+			}
+			names++
+
+			resp, _, err := client.ExchangeContext(ctx, req, *addr)
+			if err != nil {
+				mismatches++
+				fmt.Printf("FAIL %s: %v\n", fqdn, err)
+				continue
+			}
+
+			// Names that pick one of many targets or switch them over time
+			// may legitimately be answered differently, so only the types
+			// of their records are compared.
+			entry := entries[name]
+			loose := len(entry.targets) > 1 || len(entry.schedules) > 0
+
+			want := verifyAnswer(w.msg, loose)
+			got := verifyAnswer(resp, loose)
+			if !slices.Equal(want, got) {
+				mismatches++
+				fmt.Printf("FAIL %s:\n  want: %s\n  got:  %s\n", fqdn,
+					strings.Join(want, "\n        "),
+					strings.Join(got, "\n        "))
+				continue
+			}
+
+			fmt.Printf("ok   %s\n", fqdn)
+		}
+	}
+
+	fmt.Printf("%d names, %d mismatches\n", names, mismatches)
+	if mismatches > 0 {
+		return 1
+	}
+	return 0
+}
+
+// verifyAnswer returns the rcode and the answer records of the response in a
+// form that does not depend on their order, TTLs or the case of their names.
+// If loose is true, then only the types of the records are kept.
+func verifyAnswer(resp *dns.Msg, loose bool) []string {
+	answer := make([]string, 0, len(resp.Answer))
+	for _, rr := range resp.Answer {
+		if loose {
+			answer = append(answer, dns.TypeToString[rr.Header().Rrtype])
+			continue
+		}
+		rr = dns.Copy(rr)
+		rr.Header().Name = strings.ToLower(rr.Header().Name)
+		rr.Header().Ttl = 0
+		answer = append(answer, rr.String())
+	}
+	slices.Sort(answer)
+	if loose {
+		answer = slices.Compact(answer)
+	}
+	return append([]string{dns.RcodeToString[resp.Rcode]}, answer...)
+}
+
+// verifyResponseWriter captures the response of a handler to a query that
+// was made locally over UDP.
+type verifyResponseWriter struct {
+	mockDNSResponseWriter
+}
+
+func (w *verifyResponseWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+
+func (w *verifyResponseWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
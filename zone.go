@@ -0,0 +1,1146 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"maps"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/256dpi/newdns"
+	"github.com/miekg/dns"
+)
+
+// zoneSet is an immutable set of zones that are served together.
+type zoneSet struct {
+	cfg     *Config
+	zones   []servedZone
+	names   map[string]map[string]*nameEntry // zone -> name -> entry
+	checker *healthChecker
+	cache   *resolveCache
+	// resolver resolves the targets of the zones.
+	resolver ipResolver
+	// serial is the serial of the SOA records of the zones.
+	serial uint32
+	// reverse is nil unless reverse_ptr is enabled.
+	reverse *reverseMapper
+	// external resolves the targets outside of the zones through the
+	// fallback. It is nil unless include_external_target_a is enabled.
+	external *resolveCache
+}
+
+// servedZone is a zone whose answers may depend on the query. The Handler of
+// the zone answers as if there were no query.
+type servedZone struct {
+	newdns.Zone
+	lookup func(name string, q zoneQuery) ([]newdns.Set, error)
+	// forward, if not nil, answers queries for names not in the zone.
+	forward dns.Handler
+	// allow, if not empty, are the only clients that may query the zone.
+	allow []netip.Prefix
+	// unmatchedNoData answers names that are not in the zone with NODATA
+	// instead of NXDOMAIN.
+	unmatchedNoData bool
+	// queryLog logs the queries for the zone.
+	queryLog bool
+}
+
+// zoneQuery is the part of a query that answers may depend on.
+type zoneQuery struct {
+	// qtype is the type of the question, or 0 if unknown.
+	qtype uint16
+	// deadline, if not zero, is when resolving targets for the query gives
+	// up, since the client will have stopped waiting by then.
+	deadline time.Time
+	// zeroTTL, if not nil, collects the lowercase owner names that are
+	// served with a TTL of 0, since newdns raises the TTL of all records to
+	// at least a second.
+	zeroTTL map[string]bool
+}
+
+// zoneSetOptions contains the parts of a zone set that are not part of the
+// config file.
+type zoneSetOptions struct {
+	// Hostname is the name server name of all zones.
+	Hostname string
+	// SelfName, if not empty, is served as SelfAddrs.
+	SelfName  string
+	SelfAddrs func() []netip.Addr
+	// Resolver resolves targets. It defaults to net.DefaultResolver.
+	Resolver ipResolver
+	// SharedCache, if not nil, shares the cached addresses of targets with
+	// other replicas.
+	SharedCache *redisCache
+	// FallbackResolver resolves targets outside of the zones through the
+	// fallback for include_external_target_a.
+	FallbackResolver ipResolver
+	// TargetDrift, if not nil, is used to warn about changes of the addresses
+	// of targets if report_target_drift is set. It is kept across reloads.
+	TargetDrift *targetDrift
+	// Cache and ExternalCache, if not nil, hold the cached addresses of the
+	// targets and of the external targets, so that they are kept across
+	// rebuilds.
+	Cache         *resolveCacheEntries
+	ExternalCache *resolveCacheEntries
+}
+
+// ipResolver resolves host names to IP addresses. It is implemented by
+// *net.Resolver, and can be replaced to not make real lookups, e.g. in tests.
+type ipResolver interface {
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+}
+
+// buildZoneSet builds a zone set out of the given zones. ctx is used for
+// resolving targets.
+func buildZoneSet(ctx context.Context, cfg *Config, zcfgs map[string]ZoneConfig, opts zoneSetOptions) (*zoneSet, error) {
+	// Dynamic sources may have added zones and names since the config file
+	// was checked.
+	var names int
+	for _, zcfg := range zcfgs {
+		names += len(zcfg)
+	}
+	if err := cfg.checkZoneLimits(len(zcfgs), names); err != nil {
+		return nil, err
+	}
+
+	resolver := opts.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	var drift *targetDrift
+	if cfg.ReportTargetDrift {
+		drift = opts.TargetDrift
+	}
+
+	set := &zoneSet{
+		cfg:      cfg,
+		zones:    make([]servedZone, 0, len(zcfgs)),
+		names:    make(map[string]map[string]*nameEntry, len(zcfgs)),
+		checker:  newHealthChecker(cfg.HealthCheck),
+		cache:    newResolveCache(ctx, resolver, time.Duration(cfg.FinalizeCacheTTL), cfg.TTLJitter, cfg.CacheMaxEntries, opts.SharedCache, drift, opts.Cache),
+		resolver: resolver,
+		serial:   1,
+	}
+	if cfg.ReversePTR {
+		set.reverse = newReverseMapper(resolver)
+	}
+	if cfg.IncludeExternalA && opts.FallbackResolver != nil {
+		set.external = newResolveCache(ctx, opts.FallbackResolver, time.Duration(cfg.FinalizeCacheTTL), cfg.TTLJitter, cfg.CacheMaxEntries, nil, nil, opts.ExternalCache)
+	}
+
+	var selfName, selfZone string
+	if opts.SelfName != "" {
+		selfName = newdns.NormalizeDomain(opts.SelfName, true, true, false)
+		for zone := range zcfgs {
+			zone = newdns.NormalizeDomain(zone, true, true, false)
+			if newdns.InZone(zone, selfName) && len(zone) > len(selfZone) {
+				selfZone = zone
+			}
+		}
+		if selfZone == "" {
+			return nil, fmt.Errorf("self name %q is not within any configured zone", selfName)
+		}
+	}
+
+	for _, rawZone := range slices.Sorted(maps.Keys(zcfgs)) {
+		zcfg := zcfgs[rawZone]
+		zone := newdns.NormalizeDomain(rawZone, true, true, false)
+		if _, ok := set.names[zone]; ok {
+			return nil, fmt.Errorf("zone %q is defined more than once", zone)
+		}
+
+		slog := slog.With(
+			"zone", zone)
+
+		zopts := cfg.ZoneOptions[zone]
+
+		zcfg = maps.Clone(zcfg)
+		maps.DeleteFunc(zcfg, func(name string, entry ZoneEntry) bool {
+			if entry.disabled() {
+				slog.Debug(
+					"skipped disabled entry",
+					"name", name,
+					"note", entry.Note)
+			}
+			return entry.disabled()
+		})
+
+		names := make(map[string]*nameEntry, len(zcfg))
+		for name, entry := range zcfg {
+			if len(entry.Addrs) > 0 {
+				addrs := entry.Addrs
+				names[name] = &nameEntry{addrs: func() []netip.Addr { return addrs }}
+				continue
+			}
+
+			if entry.Rcode != "" {
+				names[name] = &nameEntry{rcode: dns.StringToRcode[entry.Rcode]}
+				continue
+			}
+
+			if entry.LOC != nil {
+				names[name] = &nameEntry{records: []dns.RR{entry.LOC.rr()}}
+				continue
+			}
+
+			if len(entry.DS) > 0 {
+				records := make([]dns.RR, len(entry.DS))
+				for i := range entry.DS {
+					records[i] = entry.DS[i].rr()
+				}
+				names[name] = &nameEntry{records: records}
+				continue
+			}
+
+			if entry.DNAME != "" {
+				names[name] = &nameEntry{records: []dns.RR{&dns.DNAME{
+					Hdr:    dns.RR_Header{Rrtype: dns.TypeDNAME},
+					Target: entry.DNAME,
+				}}}
+				continue
+			}
+
+			targets := make([]*nameTarget, 0, len(entry.Targets))
+			for _, tcfg := range entry.Targets {
+				tcfg.Target = zopts.qualify(tcfg.Target)
+				target, err := newNameTarget(tcfg)
+				if err != nil {
+					return nil, fmt.Errorf("invalid target %q for %q in zone %q: %w", tcfg.Target, name, zone, err)
+				}
+				targets = append(targets, target)
+				set.checker.Add(target)
+
+				slog.Debug(
+					"added target into zone",
+					"name", name,
+					"target", target.target,
+					"note", entry.Note)
+			}
+			schedules := make([]*schedule, 0, len(entry.Schedule))
+			for _, scfg := range entry.Schedule {
+				scfg.Target = zopts.qualify(scfg.Target)
+				s, err := scfg.parse()
+				if err != nil {
+					return nil, fmt.Errorf("invalid schedule for %q in zone %q: %w", name, zone, err)
+				}
+				schedules = append(schedules, s)
+			}
+
+			as := zopts.as(cmp.Or(entry.As, zopts.Defaults.As))
+			if name == "" && (as == "" || as == entryAsCNAME) {
+				// A CNAME cannot be at the zone apex, so always serve the
+				// addresses of the targets there.
+				as = entryAsAlias
+			}
+
+			names[name] = &nameEntry{
+				targets:   targets,
+				schedules: schedules,
+				as:        as,
+				txt:       txtRecords(entry.TXT),
+				mx:        mxRecords(entry.MX),
+			}
+		}
+
+		for name, entry := range zcfg {
+			names[name].note = entry.Note
+			names[name].ttl = (*time.Duration)(cmp.Or(entry.TTL, zopts.Defaults.TTL))
+			names[name].finalize = cmp.Or(entry.Finalize, zopts.Defaults.Finalize)
+			if noCache := cmp.Or(entry.NoCache, zopts.Defaults.NoCache); noCache != nil {
+				names[name].noCache = *noCache
+			}
+		}
+
+		if zone == selfZone {
+			name := newdns.TrimZone(zone, selfName)
+			names[name] = &nameEntry{addrs: opts.SelfAddrs}
+
+			slog.Debug(
+				"added self addresses into zone",
+				"name", name)
+		}
+
+		set.names[zone] = names
+
+		if set.reverse != nil {
+			for name, entry := range names {
+				set.reverse.Add(joinDomain(name, zone), entry)
+			}
+		}
+
+		rewrites := zopts.Rewrite
+		lookup := func(name string, q zoneQuery) ([]newdns.Set, error) {
+			slog := slog.With(
+				"name", name)
+
+			entry, ok := names[name]
+			if !ok {
+				entry = rewriteName(name, rewrites)
+				if entry != nil {
+					entry.as = zopts.as(zopts.Defaults.As)
+					entry.ttl = (*time.Duration)(zopts.Defaults.TTL)
+					entry.finalize = zopts.Defaults.Finalize
+					entry.noCache = zopts.Defaults.NoCache != nil && *zopts.Defaults.NoCache
+				}
+			}
+			if entry == nil {
+				slog.Debug(
+					"no target found for name")
+				return nil, nil
+			}
+
+			ctx := ctx
+			if !q.deadline.IsZero() {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithDeadline(ctx, q.deadline)
+				defer cancel()
+			}
+
+			fqdn := joinDomain(name, zone)
+			if q.zeroTTL != nil && entry.expire(cfg) == 0 {
+				q.zeroTTL[strings.ToLower(fqdn)] = true
+			}
+
+			return entry.sets(ctx, cfg, set.cache, fqdn, q, slog)
+		}
+
+		var forward dns.Handler
+		if zopts.ForwardTo != "" && !cfg.AuthoritativeOnly {
+			forward = newProxy(cfg, zopts.ForwardTo)
+		}
+
+		// newdns requires the MNAME to be one of the name servers.
+		mname := cmp.Or(zopts.SOAMName, cfg.SOAMName, opts.Hostname+".")
+
+		set.zones = append(set.zones, servedZone{
+			Zone: newdns.Zone{
+				Name:             zone,
+				MasterNameServer: mname,
+				AdminEmail:       cmp.Or(zopts.SOARName, cfg.SOARName),
+				// newdns raises the TTL of all records to at least MinTTL,
+				// which defaults to 5 minutes and would override expire. The
+				// SOA minimum is set from negative_ttl instead.
+				MinTTL:         time.Second,
+				AllNameServers: []string{mname, opts.Hostname + "."},
+				Handler: func(name string) ([]newdns.Set, error) {
+					return lookup(name, zoneQuery{})
+				},
+			},
+			lookup:  lookup,
+			forward: forward,
+			allow:   zopts.Allow,
+
+			unmatchedNoData: zopts.UnmatchedNoData,
+			queryLog:        zopts.QueryLog,
+		})
+	}
+
+	// Sort the most specific zones first, so that served picks the same zone
+	// for nested zones every time.
+	slices.SortFunc(set.zones, func(a, b servedZone) int {
+		return cmp.Or(cmp.Compare(len(b.Name), len(a.Name)), strings.Compare(a.Name, b.Name))
+	})
+
+	return set, nil
+}
+
+// find returns the most specific zone that the given name belongs to, or nil
+// if there is none. The zone answers the given query.
+func (s *zoneSet) find(name string, q zoneQuery) *newdns.Zone {
+	found := s.served(name)
+	if found == nil {
+		return nil
+	}
+	// Return a copy, since newdns fills in the defaults of the zone on every
+	// request.
+	zone := found.Zone
+
+	// newdns calls the handler again for every CNAME within the zone that it
+	// follows, so the chain is cut off here. Other lookups, such as of the
+	// exchanges of MX records, start a new chain.
+	var chain []string
+	var next string
+	zone.Handler = func(name string) ([]newdns.Set, error) {
+		if name != next {
+			chain = chain[:0]
+		}
+		if slices.Contains(chain, name) {
+			slog.Warn(
+				"CNAME loop in zone",
+				"zone", zone.Name,
+				"chain", append(chain, name))
+			return nil, fmt.Errorf("CNAME loop at %q", name)
+		}
+		// Every name in the chain so far was answered with a CNAME, and the
+		// queried name itself is always answered.
+		if len(chain) > 0 && len(chain) >= s.cfg.MaxCNAMEDepth {
+			slog.Warn(
+				"CNAME chain in zone is longer than max_cname_depth, answering with the chain so far",
+				"zone", zone.Name,
+				"chain", chain,
+				"max_cname_depth", s.cfg.MaxCNAMEDepth)
+			return nil, nil
+		}
+		chain = append(chain, name)
+
+		sets, err := found.lookup(name, q)
+		next = ""
+		if len(sets) == 1 && sets[0].Type == newdns.CNAME {
+			target := newdns.NormalizeDomain(sets[0].Records[0].Address, true, false, false)
+			next = newdns.TrimZone(zone.Name, target)
+		}
+		return sets, err
+	}
+	return &zone
+}
+
+// served returns the most specific served zone that the given name belongs
+// to, or nil if there is none.
+func (s *zoneSet) served(name string) *servedZone {
+	// The zones are sorted by how specific they are.
+	for i := range s.zones {
+		if newdns.InZone(s.zones[i].Name, name) {
+			return &s.zones[i]
+		}
+	}
+	return nil
+}
+
+// answer returns the response to the query for names that newdns cannot
+// answer, or nil if newdns should answer it. name is the normalized name of the
+// question.
+func (s *zoneSet) answer(req *dns.Msg, name string) *dns.Msg {
+	found := s.served(name)
+	if found == nil {
+		return nil
+	}
+
+	names := s.names[found.Name]
+	rel := newdns.TrimZone(found.Name, name)
+	qtype := req.Question[0].Qtype
+	ttlOf := func(e *nameEntry) time.Duration {
+		ttl := e.expire(s.cfg)
+		if ttl == 0 {
+			return 0
+		}
+		return max(jitterTTL(ttl, s.cfg.TTLJitter), time.Second)
+	}
+
+	resp := newResponse(req)
+	resp.Authoritative = true
+
+	// Names below a DNAME are answered by it, regardless of their own entries.
+	for parent := rel; parent != ""; {
+		_, parent, _ = strings.Cut(parent, ".")
+		if e := names[parent]; e != nil && len(e.records) > 0 && e.records[0].Header().Rrtype == dns.TypeDNAME {
+			owner := joinDomain(parent, found.Name)
+			ttl := ttlOf(e)
+			dname := entryRecords(e, owner, ttl)[0].(*dns.DNAME)
+
+			// Synthesize the CNAME as RFC 6672 describes, so that resolvers
+			// that do not know DNAME still get an answer.
+			target := strings.TrimSuffix(name, owner) + dname.Target
+			if _, ok := dns.IsDomainName(target); !ok || len(target) > 255 {
+				resp.Rcode = dns.RcodeYXDomain
+				return resp
+			}
+
+			resp.Answer = []dns.RR{dname, &dns.CNAME{
+				Hdr:    zoneRRHeader(req.Question[0].Name, dns.TypeCNAME, ttl),
+				Target: target,
+			}}
+			return resp
+		}
+	}
+
+	entry := names[rel]
+	switch {
+	case entry == nil:
+		return nil
+	case entry.rcode != 0:
+		// rcode entries are mostly used to block names.
+		resp.Rcode = entry.rcode
+		setExtendedError(req, resp, dns.ExtendedErrorCodeBlocked, "")
+	case qtype == dns.TypeAAAA && s.cfg.FastAAAANoData && entry.ipv4Only(s.cfg):
+		// Answer right away instead of resolving the targets only to find
+		// out that there are no IPv6 addresses.
+		zone := found.Zone
+		if err := zone.Validate(); err != nil {
+			return nil
+		}
+		resp.Ns = []dns.RR{zoneSOA(zone, s.serial)}
+	case len(entry.records) > 0 && qtype != dns.TypeANY:
+		if qtype == entry.records[0].Header().Rrtype {
+			resp.Answer = entryRecords(entry, req.Question[0].Name, ttlOf(entry))
+		} else {
+			// The name exists, but has no records of this type.
+			zone := found.Zone
+			if err := zone.Validate(); err != nil {
+				return nil
+			}
+			resp.Ns = []dns.RR{zoneSOA(zone, s.serial)}
+		}
+	default:
+		return nil
+	}
+
+	return resp
+}
+
+// entryRecords returns copies of the static records of the entry with their
+// headers filled in.
+func entryRecords(e *nameEntry, name string, ttl time.Duration) []dns.RR {
+	rrs := make([]dns.RR, len(e.records))
+	for i, record := range e.records {
+		rrs[i] = dns.Copy(record)
+		*rrs[i].Header() = zoneRRHeader(name, record.Header().Rrtype, ttl)
+	}
+	return rrs
+}
+
+// soaMbox converts the email address to the RNAME of a SOA record like newdns
+// does, escaping dots in the local part.
+func soaMbox(email string) string {
+	local, domain, _ := strings.Cut(email, "@")
+	return dns.Fqdn(strings.ReplaceAll(local, ".", "\\.") + "." + domain)
+}
+
+// zoneSOA returns the SOA record of the zone like newdns serves it. The zone
+// must be validated, which fills in its defaults.
+func zoneSOA(zone newdns.Zone, serial uint32) *dns.SOA {
+	return &dns.SOA{
+		Hdr:     zoneRRHeader(zone.Name, dns.TypeSOA, zone.SOATTL),
+		Ns:      zone.MasterNameServer,
+		Mbox:    soaMbox(zone.AdminEmail),
+		Serial:  serial,
+		Refresh: uint32(zone.Refresh / time.Second),
+		Retry:   uint32(zone.Retry / time.Second),
+		Expire:  uint32(zone.Expire / time.Second),
+		Minttl:  uint32(zone.MinTTL / time.Second),
+	}
+}
+
+// targets returns the targets of the names of the zones, including scheduled
+// ones. Targets of rewrite rules are not known in advance and not included.
+func (s *zoneSet) targets() map[string]bool {
+	targets := make(map[string]bool)
+	for _, names := range s.names {
+		for _, entry := range names {
+			for _, t := range entry.targets {
+				targets[t.target] = true
+			}
+			for _, sched := range entry.schedules {
+				targets[sched.target.target] = true
+			}
+		}
+	}
+	return targets
+}
+
+// rewriteName returns the entry that the first matching rule rewrites the name
+// to, or nil if no rule matches.
+func rewriteName(name string, rules []RewriteRule) *nameEntry {
+	for _, rule := range rules {
+		m := rule.Match.FindStringSubmatchIndex(name)
+		if m == nil {
+			continue
+		}
+
+		target := rule.Match.ExpandString(nil, rule.Replace, name, m)
+		t, err := newNameTarget(TargetConfig{Target: string(target), Weight: 1})
+		if err != nil {
+			return nil
+		}
+
+		slog.Debug(
+			"rewrote name to target",
+			"name", name,
+			"target", t.target)
+
+		return &nameEntry{targets: []*nameTarget{t}}
+	}
+	return nil
+}
+
+// nameEntry is a single name within a zone.
+type nameEntry struct {
+	targets []*nameTarget
+	// schedules replace the targets while they are active.
+	schedules []*schedule
+	// as is how the targets are served, or empty to follow finalize.
+	as string
+	// ttl and finalize, if set, override expire and finalize.
+	ttl      *time.Duration
+	finalize *bool
+	// noCache resolves the targets on every query, bypassing the cache.
+	noCache bool
+	// addrs, if not nil, returns the addresses that the name is served as
+	// directly instead of its targets.
+	addrs func() []netip.Addr
+	// rcode, if not 0, is the response code that the name is answered with
+	// instead. It is handled before newdns, since newdns cannot respond with
+	// arbitrary codes.
+	rcode int
+	// records, if not empty, are records of a type that newdns does not
+	// support, such as LOC, DNAME or DS, which the name is served as instead.
+	// They all have the same type, and only the type of their headers is set.
+	// They are also handled before newdns.
+	records []dns.RR
+	// txt and mx are static records that are served along with the targets.
+	txt []newdns.Record
+	mx  []newdns.Record
+	// note is the note of the entry in the config.
+	note string
+}
+
+// expire returns the TTL of the records of the entry.
+func (e *nameEntry) expire(cfg *Config) time.Duration {
+	if e.ttl != nil {
+		return *e.ttl
+	}
+	return time.Duration(cfg.Expire)
+}
+
+// txtRecords returns a TXT record for each of the texts, which are split into
+// strings of at most 255 bytes.
+func txtRecords(texts []string) []newdns.Record {
+	records := make([]newdns.Record, 0, len(texts))
+	for _, text := range texts {
+		var record newdns.Record
+		for len(text) > 255 {
+			record.Data = append(record.Data, text[:255])
+			text = text[255:]
+		}
+		record.Data = append(record.Data, text)
+		records = append(records, record)
+	}
+	return records
+}
+
+// mxRecords returns the MX records of the configs.
+func mxRecords(mxs []MXConfig) []newdns.Record {
+	records := make([]newdns.Record, 0, len(mxs))
+	for _, mx := range mxs {
+		records = append(records, newdns.Record{Address: mx.Exchange, Priority: mx.Preference})
+	}
+	return records
+}
+
+// sets returns the record sets that the entry is served as under the given
+// FQDN.
+func (e *nameEntry) sets(ctx context.Context, cfg *Config, cache *resolveCache, fqdn string, q zoneQuery, slog *slog.Logger) ([]newdns.Set, error) {
+	ttl := jitterTTL(e.expire(cfg), cfg.TTLJitter)
+
+	if e.addrs != nil {
+		return addrsToSets(fqdn, e.addrs(), ttl), nil
+	}
+	if e.rcode != 0 || len(e.records) > 0 {
+		return nil, nil
+	}
+
+	// Static records are served along with the addresses of the targets, or
+	// on their own for queries of their type.
+	var static []newdns.Set
+	if len(e.txt) > 0 {
+		static = append(static, newdns.Set{Name: fqdn, Type: newdns.TXT, Records: e.txt, TTL: ttl})
+	}
+	if len(e.mx) > 0 {
+		static = append(static, newdns.Set{Name: fqdn, Type: newdns.MX, Records: e.mx, TTL: ttl})
+	}
+	if len(e.targets) == 0 || (q.qtype == dns.TypeTXT && len(e.txt) > 0) || (q.qtype == dns.TypeMX && len(e.mx) > 0) {
+		return static, nil
+	}
+
+	targets := e.targets
+	for _, s := range e.schedules {
+		if s.active(time.Now()) {
+			slog.Debug(
+				"schedule is active, serving its target",
+				"target", s.target.target)
+			targets = []*nameTarget{s.target}
+			break
+		}
+	}
+
+	targets, failOpen := selectTargets(targets)
+	if failOpen {
+		slog.Warn(
+			"all targets are unhealthy, serving all of them")
+	}
+
+	switch as := e.servedAs(cfg, q.qtype, targets); as {
+	case entryAsA, entryAsAlias:
+		network := cfg.FinalizeFamily.network()
+		if as == entryAsA {
+			if network == "ip6" {
+				return static, nil
+			}
+			network = "ip4"
+		}
+
+		var addrs []netip.Addr
+		for _, target := range targets {
+			var ips []net.IP
+			var expires time.Time
+			var err error
+			if e.noCache {
+				ips, err = cache.resolve(ctx, target, network)
+			} else {
+				ips, expires, err = cache.lookupIP(ctx, target, network)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to resolve target: %w", err)
+			}
+			if !expires.IsZero() {
+				// Don't let clients cache the addresses for longer than we do.
+				ttl = min(ttl, time.Until(expires))
+			}
+
+			slog.Debug(
+				"resolved target to IPs",
+				"target", target.target,
+				"ips", ips)
+
+			for _, ip := range ips {
+				// Multiple targets may resolve to the same IP.
+				if addr, ok := netip.AddrFromSlice(ip); ok && !slices.Contains(addrs, addr.Unmap()) {
+					addrs = append(addrs, addr.Unmap())
+				}
+			}
+		}
+
+		return append(addrsToSets(fqdn, addrs, ttl), static...), nil
+	default:
+		// A CNAME cannot have other records next to it, so any static
+		// records are only served for queries of their type.
+		target := pickWeightedTarget(targets)
+		return []newdns.Set{
+			{
+				Name:    fqdn,
+				Type:    newdns.CNAME,
+				Records: []newdns.Record{{Address: target.target}},
+				TTL:     ttl,
+			},
+		}, nil
+	}
+}
+
+// servedAs returns how the entry is served with the given targets for queries
+// of qtype. It is one of the entryAs constants.
+func (e *nameEntry) servedAs(cfg *Config, qtype uint16, targets []*nameTarget) string {
+	finalize := cfg.Finalize
+	if e.finalize != nil {
+		finalize = *e.finalize
+	}
+
+	as := e.as
+	if as == "" {
+		as = entryAsCNAME
+		if finalize && cfg.finalizesQtype(qtype) {
+			as = entryAsAlias
+		}
+	}
+	if as == entryAsCNAME && slices.ContainsFunc(targets, func(t *nameTarget) bool { return t.addr.IsValid() }) {
+		// Addresses cannot be the targets of CNAMEs.
+		as = entryAsAlias
+	}
+	return as
+}
+
+// ipv4Only returns whether the entry can only be served as A records for
+// AAAA queries, without having to resolve its targets. Entries that are served
+// as CNAMEs or that only have static records are not.
+func (e *nameEntry) ipv4Only(cfg *Config) bool {
+	is4 := func(addr netip.Addr) bool { return addr.Is4() || addr.Is4In6() }
+
+	if e.addrs != nil {
+		addrs := e.addrs()
+		return len(addrs) > 0 && !slices.ContainsFunc(addrs, func(addr netip.Addr) bool { return !is4(addr) })
+	}
+	if e.rcode != 0 || len(e.records) > 0 || len(e.targets) == 0 {
+		return false
+	}
+
+	targets := slices.Clone(e.targets)
+	for _, s := range e.schedules {
+		targets = append(targets, s.target)
+	}
+
+	switch e.servedAs(cfg, dns.TypeAAAA, targets) {
+	case entryAsA:
+		return true
+	case entryAsAlias:
+		if cfg.FinalizeFamily == familyIPv4 {
+			return true
+		}
+		return !slices.ContainsFunc(targets, func(t *nameTarget) bool { return !is4(t.addr) })
+	default:
+		return false
+	}
+}
+
+// lookupIP resolves the target to its IP addresses of the given network, which
+// is one of "ip", "ip4" or "ip6". Targets that are IP addresses resolve to
+// themselves.
+func (t *nameTarget) lookupIP(ctx context.Context, resolver ipResolver, network string) ([]net.IP, error) {
+	if t.addr.IsValid() {
+		if (network == "ip4" && !t.addr.Is4()) || (network == "ip6" && t.addr.Is4()) {
+			return nil, nil
+		}
+		return []net.IP{t.addr.AsSlice()}, nil
+	}
+	return resolver.LookupIP(ctx, network, t.target)
+}
+
+// jitterTTL randomly changes ttl by up to the fraction jitter of it in either
+// direction, so that records which share a TTL don't all expire at once.
+func jitterTTL(ttl time.Duration, jitter float64) time.Duration {
+	if jitter <= 0 {
+		return ttl
+	}
+	return time.Duration(float64(ttl) * (1 + jitter*(2*rand.Float64()-1)))
+}
+
+// addrsToSets returns an A and an AAAA set for the given addresses. Sets that
+// would be empty are omitted.
+func addrsToSets(fqdn string, addrs []netip.Addr, ttl time.Duration) []newdns.Set {
+	v4 := newdns.Set{Name: fqdn, Type: newdns.A, TTL: ttl}
+	v6 := newdns.Set{Name: fqdn, Type: newdns.AAAA, TTL: ttl}
+
+	for _, addr := range addrs {
+		record := newdns.Record{Address: addr.String()}
+		if addr.Is4() {
+			v4.Records = append(v4.Records, record)
+		} else {
+			v6.Records = append(v6.Records, record)
+		}
+	}
+
+	sets := make([]newdns.Set, 0, 2)
+	if len(v4.Records) > 0 {
+		sets = append(sets, v4)
+	}
+	if len(v6.Records) > 0 {
+		sets = append(sets, v6)
+	}
+	return sets
+}
+
+// appendTargetAddrs resolves the target that the CNAME chain in the response
+// ends at and appends its addresses to the answer, saving the client another
+// lookup. Nothing is appended if the chain was already resolved, if the query
+// is not for A or AAAA, or if the addresses do not fit into a UDP response.
+func appendTargetAddrs(ctx context.Context, resolver ipResolver, w dns.ResponseWriter, req, resp *dns.Msg) {
+	qtype := req.Question[0].Qtype
+
+	var network string
+	switch qtype {
+	case dns.TypeA:
+		network = "ip4"
+	case dns.TypeAAAA:
+		network = "ip6"
+	default:
+		return
+	}
+
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) == 0 {
+		return
+	}
+
+	cname, ok := resp.Answer[len(resp.Answer)-1].(*dns.CNAME)
+	if !ok {
+		return
+	}
+
+	ips, err := resolver.LookupIP(ctx, network, cname.Target)
+	if err != nil {
+		slog.Debug(
+			"failed to resolve CNAME target for the answer",
+			"target", cname.Target,
+			"err", err)
+		return
+	}
+
+	hdr := dns.RR_Header{
+		Name:   cname.Target,
+		Rrtype: qtype,
+		Class:  dns.ClassINET,
+		Ttl:    cname.Hdr.Ttl,
+	}
+
+	answer := resp.Answer
+	for _, ip := range ips {
+		if qtype == dns.TypeA {
+			resp.Answer = append(resp.Answer, &dns.A{Hdr: hdr, A: ip})
+		} else {
+			resp.Answer = append(resp.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+
+	if w.RemoteAddr().Network() == "udp" && resp.Len() > udpBufferSize(req) {
+		resp.Answer = answer
+	}
+}
+
+// appendExternalTargetAddrs resolves the target that the CNAME chain in the
+// response ends at through the fallback if it is outside of the zones, and
+// appends its addresses to the additional section. Nothing is appended if
+// include_external_target_a is disabled, if the query is not for A or AAAA, or
+// if the addresses do not fit into a UDP response.
+func (s *zoneSet) appendExternalTargetAddrs(ctx context.Context, w dns.ResponseWriter, req, resp *dns.Msg) {
+	if s.external == nil {
+		return
+	}
+
+	qtype := req.Question[0].Qtype
+
+	var network string
+	switch qtype {
+	case dns.TypeA:
+		network = "ip4"
+	case dns.TypeAAAA:
+		network = "ip6"
+	default:
+		return
+	}
+
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) == 0 {
+		return
+	}
+
+	cname, ok := resp.Answer[len(resp.Answer)-1].(*dns.CNAME)
+	if !ok || s.served(newdns.NormalizeDomain(cname.Target, true, false, false)) != nil {
+		return
+	}
+
+	target, err := newNameTarget(TargetConfig{Target: cname.Target, Weight: 1})
+	if err != nil {
+		return
+	}
+
+	ips, expires, err := s.external.lookupIP(ctx, target, network)
+	if err != nil {
+		slog.Debug(
+			"failed to resolve external CNAME target through the fallback",
+			"target", cname.Target,
+			"err", err)
+		return
+	}
+
+	ttl := cname.Hdr.Ttl
+	if !expires.IsZero() {
+		ttl = min(ttl, uint32(max(time.Until(expires), 0)/time.Second))
+	}
+	hdr := dns.RR_Header{
+		Name:   cname.Target,
+		Rrtype: qtype,
+		Class:  dns.ClassINET,
+		Ttl:    ttl,
+	}
+
+	extra := resp.Extra
+	for _, ip := range ips {
+		if qtype == dns.TypeA {
+			resp.Extra = append(resp.Extra, &dns.A{Hdr: hdr, A: ip})
+		} else {
+			resp.Extra = append(resp.Extra, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+
+	if w.RemoteAddr().Network() == "udp" && resp.Len() > udpBufferSize(req) {
+		resp.Extra = extra
+	}
+}
+
+// clearZeroTTLs sets the TTL of the answer records of the names that are
+// served with a TTL of 0 back to 0, after newdns raised it.
+func clearZeroTTLs(resp *dns.Msg, zeroTTL map[string]bool) {
+	if len(zeroTTL) == 0 {
+		return
+	}
+	for _, rr := range resp.Answer {
+		if zeroTTL[strings.ToLower(rr.Header().Name)] {
+			rr.Header().Ttl = 0
+		}
+	}
+}
+
+// minimizeResponse removes the records that are not needed to answer the query
+// like BIND's minimal-responses: the NS records of the zone from the authority
+// section and all records from the additional section. Only the SOA record of
+// negative answers and the OPT record are kept.
+func minimizeResponse(resp *dns.Msg) {
+	resp.Ns = slices.DeleteFunc(resp.Ns, func(rr dns.RR) bool {
+		return rr.Header().Rrtype != dns.TypeSOA
+	})
+	resp.Extra = slices.DeleteFunc(resp.Extra, func(rr dns.RR) bool {
+		return rr.Header().Rrtype != dns.TypeOPT
+	})
+}
+
+// applyMinTTLs raises the TTLs of the records in the response to the min_ttl of
+// their type.
+func applyMinTTLs(resp *dns.Msg, cfg *Config) {
+	for _, rrs := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range rrs {
+			if floor := uint32(cfg.minTTL(rr.Header().Rrtype) / time.Second); rr.Header().Ttl < floor {
+				rr.Header().Ttl = floor
+			}
+		}
+	}
+}
+
+// setNegativeTTL sets the minimum field of the SOA records in the response,
+// which together with the SOA's own TTL determines how long resolvers cache
+// negative answers. newdns ties the minimum to the lowest TTL of all records,
+// so it is rewritten here instead.
+func setNegativeTTL(resp *dns.Msg, ttl time.Duration) {
+	secs := uint32(ttl / time.Second)
+	for _, rr := range resp.Answer {
+		if soa, ok := rr.(*dns.SOA); ok {
+			soa.Minttl = secs
+		}
+	}
+	for _, rr := range resp.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			soa.Minttl = secs
+			soa.Hdr.Ttl = min(soa.Hdr.Ttl, secs)
+		}
+	}
+}
+
+// Values of Config.AnswerOrder.
+const (
+	// answerOrderFixed keeps the records in the order they were produced in,
+	// which is the config order for static records.
+	answerOrderFixed = "fixed"
+	// answerOrderRandom shuffles the records on every query.
+	answerOrderRandom = "random"
+	// answerOrderRoundRobin rotates the records by one on every query.
+	answerOrderRoundRobin = "round-robin"
+	// answerOrderClientAffinity orders the records depending only on the
+	// client and the records, which keeps clients sticky to the same record.
+	answerOrderClientAffinity = "client-affinity"
+)
+
+// answerRotation counts the queries that were answered with round-robin.
+var answerRotation atomic.Uint64
+
+// orderAnswers orders the records within every RRset of the answer according
+// to order, so that clients that only use the first record spread their load.
+// This applies to every answer of the zones, no matter how it was produced.
+func orderAnswers(resp *dns.Msg, order string, client netip.Addr) {
+	if order == answerOrderFixed {
+		return
+	}
+
+	rotation := answerRotation.Add(1)
+
+	for i := 0; i < len(resp.Answer); {
+		j := i + 1
+		for j < len(resp.Answer) && sameRRset(resp.Answer[i], resp.Answer[j]) {
+			j++
+		}
+
+		rrset := resp.Answer[i:j]
+		i = j
+		if len(rrset) < 2 {
+			continue
+		}
+
+		swap := func(a, b int) { rrset[a], rrset[b] = rrset[b], rrset[a] }
+
+		switch order {
+		case answerOrderRandom:
+			rand.Shuffle(len(rrset), swap)
+		case answerOrderRoundRobin, answerOrderClientAffinity:
+			// Resolved addresses may come in any order, so start from a
+			// stable one.
+			slices.SortFunc(rrset, func(a, b dns.RR) int {
+				return strings.Compare(a.String(), b.String())
+			})
+
+			if order == answerOrderRoundRobin {
+				n := int(rotation % uint64(len(rrset)))
+				slices.Reverse(rrset[:n])
+				slices.Reverse(rrset[n:])
+				slices.Reverse(rrset)
+				continue
+			}
+
+			h := fnv.New64a()
+			h.Write(client.AsSlice())
+			h.Write([]byte(strings.ToLower(rrset[0].Header().Name)))
+			rand.New(rand.NewPCG(h.Sum64(), uint64(rrset[0].Header().Rrtype))).Shuffle(len(rrset), swap)
+		}
+	}
+}
+
+func sameRRset(a, b dns.RR) bool {
+	ha, hb := a.Header(), b.Header()
+	return ha.Rrtype == hb.Rrtype && ha.Class == hb.Class && strings.EqualFold(ha.Name, hb.Name)
+}
+
+// Values of Config.Truncation.
+const (
+	// truncationEmpty sets the TC bit and leaves out all records of responses
+	// that don't fit, so that clients retry over TCP.
+	truncationEmpty = "empty"
+	// truncationPartial keeps as many records as fit. The TC bit is only set
+	// if no answer records fit, so that clients use the partial answer
+	// instead of retrying over TCP.
+	truncationPartial = "partial"
+)
+
+// truncateResponse truncates the response if it was queried over UDP and is
+// larger than the client accepts. The OPT record is always kept.
+func truncateResponse(w dns.ResponseWriter, req, resp *dns.Msg, mode string) {
+	size := udpBufferSize(req)
+	if w.RemoteAddr().Network() != "udp" || resp.Len() <= size {
+		return
+	}
+
+	switch mode {
+	case truncationPartial:
+		resp.Truncate(size)
+		if len(resp.Answer) > 0 {
+			resp.Truncated = false
+		}
+	default:
+		resp.Truncated = true
+		resp.Answer = nil
+		resp.Ns = nil
+		resp.Extra = slices.DeleteFunc(resp.Extra, func(rr dns.RR) bool {
+			return rr.Header().Rrtype != dns.TypeOPT
+		})
+	}
+}
+
+// streamResponseWriter reports its client as a TCP client, so that newdns
+// doesn't truncate the responses written to it, which is left to
+// [truncateResponse] after they were completed.
+type streamResponseWriter struct {
+	dns.ResponseWriter
+}
+
+func (w streamResponseWriter) RemoteAddr() net.Addr {
+	addrPort, _ := netip.ParseAddrPort(w.ResponseWriter.RemoteAddr().String())
+	return net.TCPAddrFromAddrPort(addrPort)
+}
+
+// udpBufferSize returns the maximum UDP response size that the client accepts.
+// Sizes below 512 bytes are treated as 512 (RFC 6891, section 6.2.3).
+func udpBufferSize(req *dns.Msg) int {
+	if opt := req.IsEdns0(); opt != nil {
+		return max(int(opt.UDPSize()), dns.MinMsgSize)
+	}
+	return dns.MinMsgSize
+}
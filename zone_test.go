@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestZeroTTL(t *testing.T) {
+	cfg := testConfig(t, `
+[zones."a.test"]
+zero = { target = "www.example.net", as = "cname", ttl = "0s" }
+zero-a = { target = "www.example.net", as = "alias", ttl = "0s" }
+cached = { target = "www.example.net", as = "cname", ttl = "1m" }
+`)
+	store := newTestStore(t, cfg, staticResolver{
+		"www.example.net.": {net.ParseIP("192.0.2.1")},
+	})
+	handler := newZoneHandler(store, nil)
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		ttl   uint32
+	}{
+		{"zero.a.test.", dns.TypeCNAME, 0},
+		{"zero-a.a.test.", dns.TypeA, 0},
+		{"cached.a.test.", dns.TypeCNAME, 60},
+	}
+
+	for _, test := range tests {
+		resp := query(t, handler, test.name, test.qtype)
+		if len(resp.Answer) == 0 {
+			t.Errorf("%s: got no answer: %v", test.name, resp)
+			continue
+		}
+		for _, rr := range resp.Answer {
+			if rr.Header().Ttl != test.ttl {
+				t.Errorf("%s: got %v, want TTL %d", test.name, rr, test.ttl)
+			}
+		}
+	}
+}
+
+func TestNestedZones(t *testing.T) {
+	cfg := testConfig(t, `
+[zones."a.test"]
+www = { target = "outer.example.net", as = "cname" }
+
+[zones."sub.a.test"]
+www = { target = "inner.example.net", as = "cname" }
+
+[zones."deep.sub.a.test"]
+"@" = { target = "deep.example.net", as = "alias" }
+`)
+	store := newTestStore(t, cfg, staticResolver{})
+	set := store.Zones()
+
+	tests := []struct {
+		name string
+		zone string
+	}{
+		{"a.test.", "a.test."},
+		{"www.a.test.", "a.test."},
+		{"xsub.a.test.", "a.test."},
+		{"sub.a.test.", "sub.a.test."},
+		{"www.sub.a.test.", "sub.a.test."},
+		{"deep.sub.a.test.", "deep.sub.a.test."},
+		{"www.deep.sub.a.test.", "deep.sub.a.test."},
+		{"b.test.", ""},
+	}
+	for _, test := range tests {
+		var got string
+		if zone := set.served(test.name); zone != nil {
+			got = zone.Name
+		}
+		if got != test.zone {
+			t.Errorf("zone of %s = %q, want %q", test.name, got, test.zone)
+		}
+	}
+
+	handler := newZoneHandler(store, nil)
+	for name, target := range map[string]string{
+		"www.a.test.":     "outer.example.net.",
+		"www.sub.a.test.": "inner.example.net.",
+	} {
+		resp := query(t, handler, name, dns.TypeCNAME)
+		if len(resp.Answer) != 1 {
+			t.Errorf("%s: got %v, want a CNAME to %s", name, resp.Answer, target)
+			continue
+		}
+		if cname, ok := resp.Answer[0].(*dns.CNAME); !ok || cname.Target != target {
+			t.Errorf("%s: got %v, want a CNAME to %s", name, resp.Answer, target)
+		}
+	}
+}
+
+func TestUDPBufferSize(t *testing.T) {
+	tests := []struct {
+		edns bool
+		size uint16
+		want int
+	}{
+		{false, 0, 512},
+		{true, 0, 512},
+		{true, 100, 512},
+		{true, 512, 512},
+		{true, 1232, 1232},
+	}
+	for _, test := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion("www.a.test.", dns.TypeA)
+		if test.edns {
+			req.SetEdns0(test.size, false)
+		}
+		if got := udpBufferSize(req); got != test.want {
+			t.Errorf("udpBufferSize with EDNS %v and size %d = %d, want %d", test.edns, test.size, got, test.want)
+		}
+	}
+}
+
+func TestTruncation(t *testing.T) {
+	// 64 A records don't fit into 512 bytes.
+	var ips []net.IP
+	for i := range 64 {
+		ips = append(ips, net.IPv4(192, 0, 2, byte(i)))
+	}
+	resolver := staticResolver{"lb.example.net.": ips}
+
+	tests := []struct {
+		name       string
+		truncation string
+		network    string
+		edns       uint16 // 0 means no EDNS
+		answers    func(n int) bool
+		truncated  bool
+	}{
+		{"empty", truncationEmpty, "udp", 0, func(n int) bool { return n == 0 }, true},
+		{"partial", truncationPartial, "udp", 0, func(n int) bool { return n > 0 && n < 64 }, false},
+		{"tiny EDNS size", truncationPartial, "udp", 100, func(n int) bool { return n > 0 && n < 64 }, false},
+		{"large EDNS size", truncationEmpty, "udp", 4096, func(n int) bool { return n == 64 }, false},
+		{"tcp", truncationEmpty, "tcp", 0, func(n int) bool { return n == 64 }, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testConfig(t, `
+shuffle_answers = false
+truncation = "`+test.truncation+`"
+
+[zones."a.test"]
+www = { target = "lb.example.net", as = "a" }
+`)
+			handler := newZoneHandler(newTestStore(t, cfg, resolver), nil)
+
+			req := new(dns.Msg)
+			req.SetQuestion("www.a.test.", dns.TypeA)
+			if test.edns > 0 {
+				req.SetEdns0(test.edns, false)
+			}
+
+			w := &testResponseWriter{network: test.network}
+			handler.ServeDNS(w, req)
+			if len(w.msgs) != 1 {
+				t.Fatalf("got %d responses, want 1", len(w.msgs))
+			}
+			resp := w.msgs[0]
+
+			if !test.answers(len(resp.Answer)) {
+				t.Errorf("got %d answers", len(resp.Answer))
+			}
+			if resp.Truncated != test.truncated {
+				t.Errorf("got TC %v, want %v", resp.Truncated, test.truncated)
+			}
+			if test.network == "udp" && resp.Len() > udpBufferSize(req) {
+				t.Errorf("response of %d bytes is larger than %d", resp.Len(), udpBufferSize(req))
+			}
+		})
+	}
+}
+
+func TestHandBuiltResponsesEchoOPT(t *testing.T) {
+	cfg := testConfig(t, `
+[debug]
+refusal_reasons = true
+
+[stats_txt]
+enable = true
+
+[zones."a.test"]
+old = { dname = "new.example.net" }
+loc = { loc = { latitude = 52.37, longitude = 4.89 } }
+blocked = { rcode = "NXDOMAIN" }
+sub = { ds = [
+	{ key_tag = 12345, algorithm = 13, digest_type = 2, digest = "2bb183af5f22588179a53b0a98631fad1a292118aa7c6a2e2f3b82e9bcf3b1af" },
+] }
+`)
+	store := newTestStore(t, cfg, staticResolver{})
+	handler := refusalHandler(store, newRefusalLog(), statsTXTHandler(store, newZoneHandler(store, nil)))
+
+	tests := []struct {
+		name  string
+		qtype uint16
+	}{
+		{"www.old.a.test.", dns.TypeA},
+		{"loc.a.test.", dns.TypeLOC},
+		{"blocked.a.test.", dns.TypeA},
+		{"sub.a.test.", dns.TypeDS},
+		{"_stats.a.test.", dns.TypeTXT},
+		{"_why.blocked.a.test.", dns.TypeTXT},
+	}
+
+	for _, test := range tests {
+		for _, edns := range []bool{true, false} {
+			req := new(dns.Msg)
+			req.SetQuestion(test.name, test.qtype)
+			if edns {
+				req.SetEdns0(1232, false)
+			}
+
+			resp := exchange(t, handler, req)
+			opt := resp.IsEdns0()
+			switch {
+			case edns && opt == nil:
+				t.Errorf("%s: response to an EDNS query has no OPT record: %v", test.name, resp)
+			case edns && opt.Version() != 0:
+				t.Errorf("%s: got OPT version %d, want 0", test.name, opt.Version())
+			case !edns && opt != nil:
+				t.Errorf("%s: response to a query without EDNS has an OPT record: %v", test.name, resp)
+			}
+		}
+	}
+}
+
+// countingResolver is an ipResolver that counts the lookups of each host.
+type countingResolver struct {
+	staticResolver
+
+	mu      sync.Mutex
+	lookups map[string]int
+}
+
+func (r *countingResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	r.mu.Lock()
+	r.lookups[dns.Fqdn(host)]++
+	r.mu.Unlock()
+	return r.staticResolver.LookupIP(ctx, network, host)
+}
+
+func (r *countingResolver) count(host string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lookups[host]
+}
+
+func TestFinalize(t *testing.T) {
+	cfg := testConfig(t, `
+finalize = true
+
+[zones."a.test"]
+www = "www.example.net"
+cname = { target = "www.example.net", finalize = false }
+`)
+	store := newTestStore(t, cfg, staticResolver{
+		"www.example.net.": {net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")},
+	})
+	handler := newZoneHandler(store, nil)
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		want  []string
+	}{
+		{"www.a.test.", dns.TypeA, []string{"A 192.0.2.1"}},
+		{"www.a.test.", dns.TypeAAAA, []string{"AAAA 2001:db8::1"}},
+		{"cname.a.test.", dns.TypeA, []string{"CNAME www.example.net."}},
+	}
+
+	for _, test := range tests {
+		resp := query(t, handler, test.name, test.qtype)
+		var got []string
+		for _, rr := range resp.Answer {
+			fields := strings.Fields(rr.String())
+			got = append(got, strings.Join(fields[3:], " "))
+		}
+		if !slices.Equal(got, test.want) {
+			t.Errorf("%s %s: got %q, want %q", test.name, dns.TypeToString[test.qtype], got, test.want)
+		}
+	}
+}
+
+func TestFinalizeCache(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		lookups int
+	}{
+		{"uncached", ``, 3},
+		{"cached", `finalize_cache_ttl = "1m"`, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testConfig(t, test.config+`
+finalize = true
+
+[zones."a.test"]
+www = "www.example.net"
+`)
+			resolver := &countingResolver{
+				staticResolver: staticResolver{"www.example.net.": {net.ParseIP("192.0.2.1")}},
+				lookups:        make(map[string]int),
+			}
+			handler := newZoneHandler(newTestStore(t, cfg, resolver), nil)
+
+			for range 3 {
+				if resp := query(t, handler, "www.a.test.", dns.TypeA); len(resp.Answer) != 1 {
+					t.Fatalf("got %v, want an A record", resp.Answer)
+				}
+			}
+			if n := resolver.count("www.example.net."); n != test.lookups {
+				t.Errorf("got %d lookups, want %d", n, test.lookups)
+			}
+		})
+	}
+}
+
+func TestMaxCNAMEDepth(t *testing.T) {
+	tests := []struct {
+		depth  int
+		cnames int
+	}{
+		{0, 1},
+		{1, 1},
+		{2, 2},
+		{3, 3},
+		{4, 3},
+	}
+
+	for _, test := range tests {
+		cfg := testConfig(t, fmt.Sprintf(`
+max_cname_depth = %d
+
+[zones."a.test"]
+a = { target = "b.a.test", as = "cname" }
+b = { target = "c.a.test", as = "cname" }
+c = { target = "d.a.test", as = "cname" }
+d = { target = "192.0.2.1", as = "a" }
+`, test.depth))
+		handler := newZoneHandler(newTestStore(t, cfg, staticResolver{}), nil)
+
+		resp := query(t, handler, "a.a.test.", dns.TypeA)
+		var cnames int
+		for _, rr := range resp.Answer {
+			if _, ok := rr.(*dns.CNAME); ok {
+				cnames++
+			}
+		}
+		if cnames != test.cnames {
+			t.Errorf("max_cname_depth %d: got %d CNAMEs in %v, want %d", test.depth, cnames, resp.Answer, test.cnames)
+		}
+	}
+}